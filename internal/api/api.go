@@ -92,6 +92,62 @@ type Response struct {
 	GitalySocketPath string
 	// Path to Gitaly HTTP resource
 	GitalyResourcePath string
+	// MaxPackSize is the maximum number of pack bytes a client may send
+	// during 'git push'. Zero means no limit.
+	MaxPackSize int64
+	// StorageQuotaRemaining is the number of bytes the repository may still
+	// grow by. If nil the repository has no storage quota.
+	StorageQuotaRemaining *int64
+	// RefRules restrict the ref updates a 'git push' may contain
+	RefRules []RefRule
+	// HideRefs lists ref prefixes that Git clients must not see, e.g.
+	// "refs/merge-requests"
+	HideRefs []string
+	// AllowRefs, if not empty, lists the only ref prefixes Git clients may see
+	AllowRefs []string
+	// UploadPackPolicy overrides the configured limits on 'git fetch'
+	// requests for this repository
+	UploadPackPolicy *UploadPackPolicy
+	// GitEnv holds extra environment variables for Git, e.g.
+	// GIT_ALTERNATE_OBJECT_DIRECTORIES for the object pool of a fork. Only a
+	// few variables are allowed.
+	GitEnv map[string]string
+}
+
+// RefRule applies to a single ref, or to all refs in a namespace if Ref ends
+// with a slash, e.g. "refs/heads/master" or "refs/merge-requests/".
+type RefRule struct {
+	Ref string
+	// Deny rejects every update to matching refs
+	Deny bool
+	// DenyDelete rejects the deletion of matching refs
+	DenyDelete bool
+	// DenyForcePush rejects non-fast-forward updates of matching refs
+	DenyForcePush bool
+}
+
+// UploadPackPolicy limits what a client may ask for in a 'git fetch'. Zero
+// values mean no limit.
+type UploadPackPolicy struct {
+	// MaxWants is the maximum number of 'want' lines
+	MaxWants int
+	// MaxDepth is the maximum depth of a shallow fetch
+	MaxDepth int
+	// AllowedFilters lists the partial clone filter specs a client may use.
+	// An entry without a value, e.g. "blob:limit", allows any value. If empty,
+	// all filters are allowed.
+	AllowedFilters []string
+	// DenyDeepenSince rejects shallow fetches with 'git fetch --shallow-since'
+	DenyDeepenSince bool
+	// DenyDeepenNot rejects shallow fetches with 'git fetch --shallow-exclude'
+	DenyDeepenNot bool
+}
+
+func (rule *RefRule) Matches(ref string) bool {
+	if strings.HasSuffix(rule.Ref, "/") {
+		return strings.HasPrefix(ref, rule.Ref)
+	}
+	return ref == rule.Ref
 }
 
 // singleJoiningSlash is taken from reverseproxy.go:NewSingleHostReverseProxy
@@ -1,6 +1,7 @@
 package artifacts
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
@@ -18,6 +19,7 @@ import (
 type artifactsUploadProcessor struct {
 	TempPath     string
 	metadataFile string
+	ctx          context.Context
 }
 
 func (a *artifactsUploadProcessor) ProcessFile(formName, fileName string, writer *multipart.Writer) error {
@@ -40,19 +42,21 @@ func (a *artifactsUploadProcessor) ProcessFile(formName, fileName string, writer
 
 	// Generate metadata and save to file
 	zipMd := exec.Command("gitlab-zip-metadata", fileName)
-	zipMd.Stderr = os.Stderr
+	zipMd.Stderr = helper.NewStderrBuffer()
 	zipMd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	zipMd.Stdout = tempFile
 
+	helper.LimitProcess("zip", zipMd)
 	if err := zipMd.Start(); err != nil {
 		return err
 	}
 	defer helper.CleanUpProcessGroup(zipMd)
+	defer helper.WatchProcessGroup(a.ctx, "zip", zipMd)()
 	if err := zipMd.Wait(); err != nil {
 		if st, ok := helper.ExitStatus(err); ok && st == zipartifacts.StatusNotZip {
 			return nil
 		}
-		return err
+		return helper.NewProcessError(zipMd, fmt.Errorf("wait for %v: %v", zipMd.Args, err))
 	}
 
 	// Pass metadata file path to Rails
@@ -86,7 +90,7 @@ func UploadArtifacts(myAPI *api.API, h http.Handler) http.Handler {
 			return
 		}
 
-		mg := &artifactsUploadProcessor{TempPath: a.TempPath}
+		mg := &artifactsUploadProcessor{TempPath: a.TempPath, ctx: r.Context()}
 		defer mg.Cleanup()
 
 		upload.HandleFileUploads(w, r, h, a.TempPath, mg)
@@ -2,6 +2,7 @@ package artifacts
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -38,12 +39,12 @@ func (e *entry) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 		return
 	}
 
-	err := unpackFileFromZip(params.Archive, params.Entry, w.Header(), w)
+	err := unpackFileFromZip(r.Context(), params.Archive, params.Entry, w.Header(), w)
 
 	if os.IsNotExist(err) {
 		http.NotFound(w, r)
 	} else if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendEntry: %v", err))
+		helper.Fail500(w, r, helper.PrefixError("SendEntry", err))
 	}
 }
 
@@ -55,24 +56,26 @@ func detectFileContentType(fileName string) string {
 	return contentType
 }
 
-func unpackFileFromZip(archiveFileName, encodedFilename string, headers http.Header, output io.Writer) error {
+func unpackFileFromZip(ctx context.Context, archiveFileName, encodedFilename string, headers http.Header, output io.Writer) error {
 	fileName, err := zipartifacts.DecodeFileEntry(encodedFilename)
 	if err != nil {
 		return err
 	}
 
 	catFile := exec.Command("gitlab-zip-cat", archiveFileName, encodedFilename)
-	catFile.Stderr = os.Stderr
+	catFile.Stderr = helper.NewStderrBuffer()
 	catFile.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	stdout, err := catFile.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("create gitlab-zip-cat stdout pipe: %v", err)
 	}
 
+	helper.LimitProcess("zip", catFile)
 	if err := catFile.Start(); err != nil {
 		return fmt.Errorf("start %v: %v", catFile.Args, err)
 	}
 	defer helper.CleanUpProcessGroup(catFile)
+	defer helper.WatchProcessGroup(ctx, "zip", catFile)()
 
 	basename := filepath.Base(fileName)
 	reader := bufio.NewReader(stdout)
@@ -106,6 +109,6 @@ func waitCatFile(cmd *exec.Cmd) error {
 	if st, ok := helper.ExitStatus(err); ok && st == zipartifacts.StatusEntryNotFound {
 		return os.ErrNotExist
 	}
-	return fmt.Errorf("wait for %v to finish: %v", cmd.Args, err)
+	return helper.NewProcessError(cmd, fmt.Errorf("wait for %v to finish: %v", cmd.Args, err))
 
 }
@@ -3,16 +3,26 @@ package config
 import (
 	"net/url"
 	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 )
 
 type Config struct {
-	Backend             *url.URL
-	Version             string
-	DocumentRoot        string
-	DevelopmentMode     bool
-	Socket              string
-	ProxyHeadersTimeout time.Duration
-	APILimit            uint
-	APIQueueLimit       uint
-	APIQueueTimeout     time.Duration
+	Backend                   *url.URL
+	Version                   string
+	DocumentRoot              string
+	DevelopmentMode           bool
+	Socket                    string
+	ProxyHeadersTimeout       time.Duration
+	APILimit                  uint
+	APIQueueLimit             uint
+	APIQueueTimeout           time.Duration
+	GitDumbHTTP               bool
+	GitUploadPackLimit        uint
+	GitUploadPackQueueLimit   uint
+	GitUploadPackQueueTimeout time.Duration
+	InfoRefsCacheSize         int64
+	PushScanHook              string
+	PushScanTimeout           time.Duration
+	UploadPackPolicy          api.UploadPackPolicy
 }
@@ -0,0 +1,352 @@
+/*
+In this file we keep the cached archives within a size and age limit
+*/
+
+package git
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	archiveCacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_archive_cache_evictions",
+			Help: "How many cached archives have been removed, partitioned by reason (size, age).",
+		},
+		[]string{"reason"},
+	)
+
+	archiveCacheEvictedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_archive_cache_evicted_bytes",
+			Help: "How many bytes of cached archives have been removed, partitioned by reason (size, age).",
+		},
+		[]string{"reason"},
+	)
+
+	archiveCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_archive_cache_bytes",
+		Help: "Number of bytes of cached archives under the archive cache root.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(archiveCacheEvictions)
+	prometheus.MustRegister(archiveCacheEvictedBytes)
+	prometheus.MustRegister(archiveCacheBytes)
+}
+
+// How often we look for archives that exceed MaxAge
+const archiveCacheJanitorInterval = time.Minute
+
+// The lock file under the cache root that makes sure only one process
+// manages the cache
+const archiveCacheLockFile = ".workhorse-archive-cache.lock"
+
+// ArchiveCacheConfig limits the archives that are cached under Root. Zero
+// limits are not enforced.
+type ArchiveCacheConfig struct {
+	Root    string
+	MaxSize int64
+	MaxAge  time.Duration
+}
+
+// The archive cache is nil unless it is configured with
+// StartArchiveCache. Archives outside the cache root are not managed.
+var archiveCache *cachedArchives
+
+type cachedArchive struct {
+	path string
+	// file identifies the file we track at path, so that we do not remove
+	// a newer file that replaced it
+	file       os.FileInfo
+	size       int64
+	lastAccess time.Time
+	// users counts the requests serving the archive. We do not remove
+	// archives that are in use.
+	users int
+}
+
+// byLastAccess sorts the most recently used archives first
+type byLastAccess []*cachedArchive
+
+func (a byLastAccess) Len() int           { return len(a) }
+func (a byLastAccess) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLastAccess) Less(i, j int) bool { return a[i].lastAccess.After(a[j].lastAccess) }
+
+// cachedArchives tracks the archives under a cache root, and removes the
+// least recently used ones. We record access times ourselves instead of
+// relying on atime, which is often disabled.
+type cachedArchives struct {
+	sync.Mutex
+	ArchiveCacheConfig
+	entries map[string]*list.Element
+	lru     *list.List // Most recently used at the front
+	size    int64
+	now     func() time.Time
+}
+
+// StartArchiveCache indexes the archives under cfg.Root and starts
+// evicting archives to stay within the limits of cfg. Only one process can
+// manage a cache root: the access times we record are not shared, so other
+// processes could remove archives that are in use here.
+func StartArchiveCache(cfg ArchiveCacheConfig) error {
+	if err := lockArchiveCache(cfg.Root); err != nil {
+		return err
+	}
+
+	c, err := newCachedArchives(cfg)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.evict()
+	c.Unlock()
+
+	archiveCache = c
+	if cfg.MaxAge > 0 {
+		go c.janitor()
+	}
+	return nil
+}
+
+// lockArchiveCache takes a lock on root for the lifetime of this process,
+// or fails if another process holds it
+func lockArchiveCache(root string) error {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return err
+	}
+	lockFile, err := os.OpenFile(filepath.Join(root, archiveCacheLockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lockFile.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("archive cache %q is managed by another process", root)
+		}
+		return fmt.Errorf("lock archive cache %q: %v", root, err)
+	}
+	// The lock is released when the process exits
+	archiveCacheLock = lockFile
+	return nil
+}
+
+// Keeps the lock file open
+var archiveCacheLock *os.File
+
+func newCachedArchives(cfg ArchiveCacheConfig) (*cachedArchives, error) {
+	root, err := filepath.Abs(cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Root = root
+
+	c := &cachedArchives{
+		ArchiveCacheConfig: cfg,
+		entries:            make(map[string]*list.Element),
+		lru:                list.New(),
+		now:                time.Now,
+	}
+
+	// Until we see requests for them, the modification time is the best
+	// guess of when archives were last used
+	var found []*cachedArchive
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Tempfiles of running generations, maybe of other processes, are
+		// not archives yet
+		if fi.Mode().IsRegular() && !isArchiveChecksumFile(path) && !isArchiveTempfile(path) && fi.Name() != archiveCacheLockFile {
+			found = append(found, &cachedArchive{path: path, file: fi, size: fi.Size(), lastAccess: fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byLastAccess(found))
+	for _, a := range found {
+		c.entries[a.path] = c.lru.PushBack(a)
+		c.size += a.size
+	}
+	archiveCacheBytes.Set(float64(c.size))
+
+	return c, nil
+}
+
+func (c *cachedArchives) manages(path string) bool {
+	return c != nil && strings.HasPrefix(filepath.Clean(path), c.Root+"/")
+}
+
+// open opens the cached archive at path. The archive is not removed until
+// release is called.
+func (c *cachedArchives) open(path string) (file *os.File, release func(), err error) {
+	if !c.manages(path) {
+		file, err = os.Open(path)
+		return file, func() {}, err
+	}
+	path = filepath.Clean(path)
+
+	c.Lock()
+	defer c.Unlock()
+
+	file, err = os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a := c.touch(path, file)
+	a.users++
+
+	return file, func() {
+		c.Lock()
+		defer c.Unlock()
+		a.users--
+	}, nil
+}
+
+// touch marks the archive at path as used just now, and starts tracking it
+// if needed. Files that are replaced, like stale bundles, get their new
+// size.
+func (c *cachedArchives) touch(path string, file *os.File) *cachedArchive {
+	if elem, ok := c.entries[path]; ok {
+		a := elem.Value.(*cachedArchive)
+		a.lastAccess = c.now()
+		c.lru.MoveToFront(elem)
+		if fi, err := file.Stat(); err == nil {
+			a.file = fi
+			c.size += fi.Size() - a.size
+			a.size = fi.Size()
+			archiveCacheBytes.Set(float64(c.size))
+		}
+		return a
+	}
+
+	a := &cachedArchive{path: path, lastAccess: c.now()}
+	if fi, err := file.Stat(); err == nil {
+		a.file = fi
+		a.size = fi.Size()
+	}
+	c.entries[path] = c.lru.PushFront(a)
+	c.size += a.size
+	archiveCacheBytes.Set(float64(c.size))
+	return a
+}
+
+// add tracks a newly generated archive and makes room for it
+func (c *cachedArchives) add(path string) {
+	if !c.manages(path) {
+		return
+	}
+	path = filepath.Clean(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	c.Lock()
+	defer c.Unlock()
+	c.touch(path, file)
+	c.evict()
+}
+
+// evict removes the archives that are too old, and then the least
+// recently used archives until the cache fits in MaxSize. The caller must
+// hold the lock. We remove the files under the lock too, so that an
+// archive that is tracked again in the meantime cannot lose its file.
+func (c *cachedArchives) evict() {
+	var evicted []*cachedArchive
+
+	if c.MaxAge > 0 {
+		deadline := c.now().Add(-c.MaxAge)
+		for elem := c.lru.Back(); elem != nil; {
+			prev := elem.Prev()
+			if a := elem.Value.(*cachedArchive); a.users == 0 && a.lastAccess.Before(deadline) {
+				evicted = append(evicted, c.untrack(elem, "age"))
+			}
+			elem = prev
+		}
+	}
+
+	if c.MaxSize > 0 {
+		for elem := c.lru.Back(); elem != nil && c.size > c.MaxSize; {
+			prev := elem.Prev()
+			if a := elem.Value.(*cachedArchive); a.users == 0 {
+				evicted = append(evicted, c.untrack(elem, "size"))
+			}
+			elem = prev
+		}
+	}
+
+	for _, a := range evicted {
+		c.removeArchive(a)
+	}
+}
+
+func (c *cachedArchives) untrack(elem *list.Element, reason string) *cachedArchive {
+	a := c.lru.Remove(elem).(*cachedArchive)
+	delete(c.entries, a.path)
+	c.size -= a.size
+	archiveCacheBytes.Set(float64(c.size))
+	archiveCacheEvictions.WithLabelValues(reason).Inc()
+	archiveCacheEvictedBytes.WithLabelValues(reason).Add(float64(a.size))
+	return a
+}
+
+// removeArchive deletes the evicted archive a and its checksum files, and
+// the directories of archives of paths or with LFS objects once they are
+// empty. The file is left alone if it has been replaced since we tracked
+// it. Requests that opened an archive before can still read it. The caller
+// must hold the lock.
+func (c *cachedArchives) removeArchive(a *cachedArchive) {
+	if fi, err := os.Lstat(a.path); err == nil && a.file != nil && !os.SameFile(fi, a.file) {
+		return
+	}
+	if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("archive cache: remove %q: %v", a.path, err)
+		return
+	}
+	for _, checksum := range archiveChecksums {
+		os.Remove(a.path + checksum.ext)
+	}
+
+	for dir := filepath.Dir(a.path); c.manages(dir); dir = filepath.Dir(dir) {
+		base := filepath.Base(dir)
+		if !strings.HasPrefix(base, "paths-") && !strings.HasPrefix(base, "lfs-") {
+			break
+		}
+		// Fails if the directory is not empty yet
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+func (c *cachedArchives) janitor() {
+	for range time.Tick(archiveCacheJanitorInterval) {
+		c.Lock()
+		c.evict()
+		c.Unlock()
+	}
+}
@@ -0,0 +1,238 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCachedArchives(t *testing.T, cfg ArchiveCacheConfig, files map[string]int) (*cachedArchives, *time.Time) {
+	for name, size := range files {
+		path := filepath.Join(cfg.Root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := newCachedArchives(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func assertCachedFiles(t *testing.T, root string, expected ...string) {
+	for _, name := range expected {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("expected %s to be cached: %v", name, err)
+		}
+	}
+
+	count := 0
+	filepath.Walk(root, func(_ string, fi os.FileInfo, _ error) error {
+		if fi != nil && fi.Mode().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	if count != len(expected) {
+		t.Errorf("expected %d cached files, found %d", len(expected), count)
+	}
+}
+
+func TestArchiveCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c, now := newTestCachedArchives(t, ArchiveCacheConfig{Root: root, MaxSize: 250}, map[string]int{
+		"a/archive.tar.gz": 100,
+		"b/archive.tar.gz": 100,
+	})
+
+	// Use a so that b is the least recently used
+	*now = now.Add(time.Second)
+	file, release, err := c.open(filepath.Join(root, "a/archive.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	release()
+
+	*now = now.Add(time.Second)
+	if err := ioutil.WriteFile(filepath.Join(root, "a/archive.zip"), make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.add(filepath.Join(root, "a/archive.zip"))
+
+	assertCachedFiles(t, root, "a/archive.tar.gz", "a/archive.zip")
+	if c.size != 200 {
+		t.Fatalf("expected size 200, got %d", c.size)
+	}
+}
+
+func TestArchiveCacheKeepsArchivesInUse(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c, now := newTestCachedArchives(t, ArchiveCacheConfig{Root: root, MaxSize: 100, MaxAge: time.Hour}, map[string]int{
+		"archive.tar.gz": 100,
+	})
+
+	file, release, err := c.open(filepath.Join(root, "archive.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	*now = now.Add(2 * time.Hour)
+	if err := ioutil.WriteFile(filepath.Join(root, "archive.zip"), make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.add(filepath.Join(root, "archive.zip"))
+
+	// archive.zip is the only archive that is not in use
+	assertCachedFiles(t, root, "archive.tar.gz")
+
+	release()
+	*now = now.Add(2 * time.Hour)
+	c.Lock()
+	c.evict()
+	c.Unlock()
+	assertCachedFiles(t, root)
+}
+
+func TestArchiveCacheIgnoresOtherPaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c, _ := newTestCachedArchives(t, ArchiveCacheConfig{Root: filepath.Join(root, "cache"), MaxSize: 1}, nil)
+
+	other := filepath.Join(root, "cache-other", "archive.zip")
+	os.MkdirAll(filepath.Dir(other), 0700)
+	if err := ioutil.WriteFile(other, make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.add(other)
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("expected %s to be left alone: %v", other, err)
+	}
+
+	var disabled *cachedArchives
+	file, release, err := disabled.open(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	release()
+}
+
+func TestArchiveCacheSkipsTempfiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c, _ := newTestCachedArchives(t, ArchiveCacheConfig{Root: root}, map[string]int{
+		"archive.tar.gz":                     100,
+		"archive.tar.gz.sha256":              10,
+		archiveTempPrefix + "archive.zip123": 100,
+		archiveCacheLockFile:                 0,
+	})
+
+	if len(c.entries) != 1 || c.size != 100 {
+		t.Fatalf("expected only archive.tar.gz to be tracked, got %d entries of %d bytes", len(c.entries), c.size)
+	}
+}
+
+func TestArchiveCacheLock(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(lock *os.File) { archiveCacheLock = lock }(archiveCacheLock)
+
+	if err := lockArchiveCache(root); err != nil {
+		t.Fatal(err)
+	}
+	defer archiveCacheLock.Close()
+
+	if err := lockArchiveCache(root); err == nil {
+		t.Fatal("expected a second lock to fail")
+	}
+}
+
+func TestArchiveCacheRemovesEmptyArchiveDirectories(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c, now := newTestCachedArchives(t, ArchiveCacheConfig{Root: root, MaxAge: time.Hour}, map[string]int{
+		"project/paths-1234/archive-docs.tar.gz":        100,
+		"project/lfs-error-5678/archive.tar.gz":         100,
+		"project/lfs-error-5678/paths-9abc/archive.zip": 100,
+	})
+
+	*now = now.Add(2 * time.Hour)
+	c.Lock()
+	c.evict()
+	c.Unlock()
+
+	assertCachedFiles(t, root)
+	entries, err := ioutil.ReadDir(filepath.Join(root, "project"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected empty archive directories to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestArchiveCacheKeepsReplacedArchives(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c, now := newTestCachedArchives(t, ArchiveCacheConfig{Root: root, MaxAge: time.Hour}, map[string]int{
+		"clone.bundle": 100,
+	})
+
+	// A new file takes the place of the tracked one, like a refreshed
+	// bundle, before the old one is evicted
+	replacement := filepath.Join(root, "clone.bundle.new")
+	if err := ioutil.WriteFile(replacement, make([]byte, 50), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, filepath.Join(root, "clone.bundle")); err != nil {
+		t.Fatal(err)
+	}
+
+	*now = now.Add(2 * time.Hour)
+	c.Lock()
+	c.evict()
+	c.Unlock()
+
+	assertCachedFiles(t, root, "clone.bundle")
+}
@@ -0,0 +1,191 @@
+/*
+In this file we keep checksums of cached archives in sidecar files, e.g.
+archive.tar.gz.sha256 next to archive.tar.gz
+*/
+
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+type archiveChecksum struct {
+	ext     string // Suffix of the sidecar file and of the URL
+	name    string // Name of the algorithm in the Digest header (RFC 3230)
+	newHash func() hash.Hash
+}
+
+var archiveChecksums = []*archiveChecksum{
+	{".sha256", "SHA-256", sha256.New},
+	{".sha512", "SHA-512", sha512.New},
+}
+
+// archiveSums holds a sum for each of archiveChecksums
+type archiveSums [][]byte
+
+// archiveHasher computes all archiveChecksums of the data written to it
+type archiveHasher []hash.Hash
+
+func newArchiveHasher() archiveHasher {
+	h := make(archiveHasher, len(archiveChecksums))
+	for i, c := range archiveChecksums {
+		h[i] = c.newHash()
+	}
+	return h
+}
+
+func (h archiveHasher) Write(p []byte) (int, error) {
+	for _, hh := range h {
+		hh.Write(p)
+	}
+	return len(p), nil
+}
+
+func (h archiveHasher) sums() archiveSums {
+	sums := make(archiveSums, len(h))
+	for i, hh := range h {
+		sums[i] = hh.Sum(nil)
+	}
+	return sums
+}
+
+// splitChecksumSuffix returns the archive name of a checksum request, e.g.
+// archive.tar.gz for archive.tar.gz.sha256, and the checksum. The checksum
+// is nil for archive requests.
+func splitChecksumSuffix(basename string) (string, *archiveChecksum) {
+	for _, c := range archiveChecksums {
+		if strings.HasSuffix(basename, c.ext) {
+			return strings.TrimSuffix(basename, c.ext), c
+		}
+	}
+	return basename, nil
+}
+
+func isArchiveChecksumFile(name string) bool {
+	_, c := splitChecksumSuffix(name)
+	return c != nil
+}
+
+// writeArchiveChecksums writes the sidecar files of the archive at
+// archivePath in the format of sha256sum(1)
+func writeArchiveChecksums(archivePath string, sums archiveSums) error {
+	for i, c := range archiveChecksums {
+		tempFile, err := prepareArchiveTempfile(path.Dir(archivePath), path.Base(archivePath)+c.ext)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tempFile.Name())
+
+		_, err = fmt.Fprintf(tempFile, "%x  %s\n", sums[i], path.Base(archivePath))
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tempFile.Name(), archivePath+c.ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readArchiveChecksums(archivePath string) (archiveSums, error) {
+	sums := make(archiveSums, len(archiveChecksums))
+	for i, c := range archiveChecksums {
+		data, err := ioutil.ReadFile(archivePath + c.ext)
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.Fields(data)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty checksum file %q", archivePath+c.ext)
+		}
+		if sums[i], err = hex.DecodeString(string(fields[0])); err != nil {
+			return nil, fmt.Errorf("checksum file %q: %v", archivePath+c.ext, err)
+		}
+	}
+	return sums, nil
+}
+
+// cachedArchiveChecksums returns the checksums of a cached archive. Archives
+// that were cached before we kept checksums get their sidecar files now.
+func cachedArchiveChecksums(archivePath string, archive *os.File) (archiveSums, error) {
+	if sums, err := readArchiveChecksums(archivePath); err == nil {
+		return sums, nil
+	}
+
+	sums, err := hashArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	return sums, writeArchiveChecksums(archivePath, sums)
+}
+
+// writeCachedArchiveChecksums writes the sidecar files of the archive that
+// was just linked to archivePath. If that is our tempfile at tempPath, the
+// archive has sums. Otherwise another generation, maybe in another
+// process, came first and its archive can have other bytes than ours.
+func writeCachedArchiveChecksums(archivePath string, tempPath string, sums archiveSums) error {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	archiveInfo, err := archive.Stat()
+	if err != nil {
+		return err
+	}
+	if tempInfo, err := os.Stat(tempPath); err != nil || !os.SameFile(archiveInfo, tempInfo) {
+		if sums, err = hashArchive(archive); err != nil {
+			return err
+		}
+	}
+	return writeArchiveChecksums(archivePath, sums)
+}
+
+func hashArchive(archive *os.File) (archiveSums, error) {
+	fi, err := archive.Stat()
+	if err != nil {
+		return nil, err
+	}
+	h := newArchiveHasher()
+	if _, err := io.Copy(h, io.NewSectionReader(archive, 0, fi.Size())); err != nil {
+		return nil, err
+	}
+	return h.sums(), nil
+}
+
+// digestHeader returns the value of a Digest header (RFC 3230) with sums
+func digestHeader(sums archiveSums) string {
+	var digests []string
+	for i, c := range archiveChecksums {
+		digests = append(digests, c.name+"="+base64.StdEncoding.EncodeToString(sums[i]))
+	}
+	return strings.Join(digests, ",")
+}
+
+func serveArchiveChecksum(w http.ResponseWriter, c *archiveChecksum, sums archiveSums, archiveFilename string) {
+	for i, cc := range archiveChecksums {
+		if cc == c {
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "private")
+			fmt.Fprintf(w, "%x  %s\n", sums[i], archiveFilename)
+			return
+		}
+	}
+}
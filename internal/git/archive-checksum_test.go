@@ -0,0 +1,136 @@
+package git
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func TestSplitChecksumSuffix(t *testing.T) {
+	for _, testCase := range []struct{ in, out, ext string }{
+		{"archive.tar.gz", "archive.tar.gz", ""},
+		{"archive.tar.gz.sha256", "archive.tar.gz", ".sha256"},
+		{"archive.zip.sha512", "archive.zip", ".sha512"},
+	} {
+		out, checksum := splitChecksumSuffix(testCase.in)
+		ext := ""
+		if checksum != nil {
+			ext = checksum.ext
+		}
+		if out != testCase.out || ext != testCase.ext {
+			t.Errorf("%q: expected %q %q, got %q %q", testCase.in, testCase.out, testCase.ext, out, ext)
+		}
+	}
+}
+
+func TestCachedArchiveChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An archive cached before we kept checksums
+	archivePath := filepath.Join(dir, "archive.tar.gz")
+	if err := ioutil.WriteFile(archivePath, []byte("archive"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	sums, err := cachedArchiveChecksums(archivePath, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sha256.Sum256([]byte("archive"))
+	if !reflect.DeepEqual(sums[0], expected[:]) {
+		t.Fatalf("expected sha256 %x, got %x", expected, sums[0])
+	}
+
+	sidecar, err := ioutil.ReadFile(archivePath + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := fmt.Sprintf("%x  archive.tar.gz\n", expected); string(sidecar) != line {
+		t.Fatalf("expected sidecar %q, got %q", line, sidecar)
+	}
+
+	read, err := readArchiveChecksums(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, sums) {
+		t.Fatalf("expected %x, got %x", sums, read)
+	}
+
+	w := httptest.NewRecorder()
+	serveArchiveChecksum(w, archiveChecksums[0], sums, "archive.tar.gz")
+	testhelper.AssertResponseBody(t, w, string(sidecar))
+	testhelper.AssertResponseHeader(t, w, "Content-Type", "text/plain; charset=utf-8")
+}
+
+func TestDigestHeader(t *testing.T) {
+	sums := newArchiveHasher().sums()
+	expected := "SHA-256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=,SHA-512=z4PhNX7vuL3xVChQ1m2AB9Yg5AULVxXcg/SpIdNs6c5H0NE8XYXysP+DGNKHfuwvY7kxvUdBeoGlODJ6+SfaPg=="
+	if header := digestHeader(sums); header != expected {
+		t.Fatalf("expected %q, got %q", expected, header)
+	}
+}
+
+func TestWriteCachedArchiveChecksumsOfOtherArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Another generation linked its archive before ours was done
+	archivePath := filepath.Join(dir, "archive.tar.gz")
+	if err := ioutil.WriteFile(archivePath, []byte("theirs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tempFile, err := prepareArchiveTempfile(dir, "archive.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempFile.Write([]byte("ours"))
+	if err := finalizeCachedArchive(tempFile, archivePath); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newArchiveHasher()
+	h.Write([]byte("ours"))
+	if err := writeCachedArchiveChecksums(archivePath, tempFile.Name(), h.sums()); err != nil {
+		t.Fatal(err)
+	}
+
+	sums, err := readArchiveChecksums(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sha256.Sum256([]byte("theirs"))
+	if !reflect.DeepEqual(sums[0], expected[:]) {
+		t.Fatalf("expected sha256 %x of the linked archive, got %x", expected, sums[0])
+	}
+
+	os.Remove(tempFile.Name())
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if isArchiveTempfile(fi.Name()) {
+			t.Errorf("unexpected tempfile %s", fi.Name())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+/*
+In this file we compress the output of 'git archive'
+
+We run the compression programs rather than compress in Go. The standard
+library has no bzip2, xz or zstd encoder, and the Go implementations of
+xz and zstd need a much newer Go than we support. The programs also get
+the timeouts, priorities and rlimits of the 'archive' kind.
+*/
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// ArchiveCompression holds the compression levels of the archive formats.
+// The compressors run single-threaded, so that the output for a given
+// level and compressor version never changes and cached archives and their
+// checksums stay the same.
+type ArchiveCompression struct {
+	Gzip  int // 1 (fastest) to 9 (best)
+	Bzip2 int // 1 to 9, the block size in units of 100k
+	Xz    int // 0 to 9, the presets of xz
+	Zstd  int // 1 to 19, or up to 22 with --ultra
+}
+
+// DefaultArchiveCompression matches the defaults of the command line tools
+var DefaultArchiveCompression = ArchiveCompression{Gzip: 6, Bzip2: 9, Xz: 6, Zstd: 3}
+
+var archiveCompression = struct {
+	sync.RWMutex
+	ArchiveCompression
+}{ArchiveCompression: DefaultArchiveCompression}
+
+// SetArchiveCompression sets the compression levels used for new archives
+func SetArchiveCompression(c ArchiveCompression) error {
+	switch {
+	case c.Gzip < 1 || c.Gzip > 9:
+		return fmt.Errorf("invalid gzip level %d", c.Gzip)
+	case c.Bzip2 < 1 || c.Bzip2 > 9:
+		return fmt.Errorf("invalid bzip2 level %d", c.Bzip2)
+	case c.Xz < 0 || c.Xz > 9:
+		return fmt.Errorf("invalid xz level %d", c.Xz)
+	case c.Zstd < 1 || c.Zstd > 22:
+		return fmt.Errorf("invalid zstd level %d", c.Zstd)
+	}
+
+	archiveCompression.Lock()
+	defer archiveCompression.Unlock()
+	archiveCompression.ArchiveCompression = c
+	return nil
+}
+
+func currentArchiveCompression() ArchiveCompression {
+	archiveCompression.RLock()
+	defer archiveCompression.RUnlock()
+	return archiveCompression.ArchiveCompression
+}
+
+func gzipCommand(level int) *exec.Cmd {
+	// -n leaves out the file name and timestamp
+	return exec.Command("gzip", "-c", "-n", "-"+strconv.Itoa(level))
+}
+
+func bzip2Command(level int) *exec.Cmd {
+	return exec.Command("bzip2", "-c", "-"+strconv.Itoa(level))
+}
+
+func xzCommand(level int) *exec.Cmd {
+	// Multi-threaded xz splits its output into blocks
+	return exec.Command("xz", "-c", "-T1", "-"+strconv.Itoa(level))
+}
+
+func zstdCommand(level int) *exec.Cmd {
+	args := []string{"-c", "-q", "-T1", "-" + strconv.Itoa(level)}
+	if level > 19 {
+		args = append(args, "--ultra")
+	}
+	return exec.Command("zstd", args...)
+}
+
+// copyCompressed copies src to dst, through compressCmd if it is not nil.
+// compressCmd gets the limits of the "archive" subprocesses.
+func copyCompressed(ctx context.Context, dst io.Writer, src io.Reader, compressCmd *exec.Cmd) error {
+	if compressCmd == nil {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	compressCmd.Stdin = src
+	compressCmd.Stdout = dst
+	compressCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	compressCmd.Stderr = helper.NewStderrBuffer()
+	helper.LimitProcess("archive", compressCmd)
+	if err := compressCmd.Start(); err != nil {
+		return fmt.Errorf("start %v: %v", compressCmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(compressCmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(ctx, "archive", compressCmd)()
+
+	if err := compressCmd.Wait(); err != nil {
+		return helper.NewProcessError(compressCmd, fmt.Errorf("wait for %v: %v", compressCmd.Args, err))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package git
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+)
+
+func TestArchiveCompressionRoundTrip(t *testing.T) {
+	input := bytes.Repeat([]byte("archive contents\n"), 10000)
+
+	decompressors := map[string]func([]byte) ([]byte, error){
+		"tar.gz": func(b []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		},
+		"tar.bz2": func(b []byte) ([]byte, error) { return ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(b))) },
+		"tar.xz":  func(b []byte) ([]byte, error) { return decompressCommand(b, "xz", "-d", "-c") },
+		"tar.zst": func(b []byte) ([]byte, error) { return decompressCommand(b, "zstd", "-d", "-c", "-q") },
+	}
+
+	for format, decompress := range decompressors {
+		compressCmd, archiveFormat := parseArchiveFormat(format, DefaultArchiveCompression)
+		if archiveFormat != "tar" || compressCmd == nil {
+			t.Fatalf("%s: expected a tar compressor, got %q", format, archiveFormat)
+		}
+		if _, err := exec.LookPath(compressCmd.Path); err != nil {
+			t.Logf("%s: skipping: %v", format, err)
+			continue
+		}
+
+		var outputs [2][]byte
+		for i := range outputs {
+			compressCmd, _ := parseArchiveFormat(format, DefaultArchiveCompression)
+			buf := &bytes.Buffer{}
+			if err := copyCompressed(context.Background(), buf, bytes.NewReader(input), compressCmd); err != nil {
+				t.Fatalf("%s: compress: %v", format, err)
+			}
+			outputs[i] = buf.Bytes()
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("%s: output differs between runs", format)
+		}
+
+		output, err := decompress(outputs[0])
+		if err != nil {
+			t.Fatalf("%s: decompress: %v", format, err)
+		}
+		if !bytes.Equal(output, input) {
+			t.Errorf("%s: round trip mismatch", format)
+		}
+	}
+}
+
+func TestArchiveCompressionLevels(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip(err)
+	}
+
+	input := &bytes.Buffer{}
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(input, "%d\n", i)
+	}
+	var outputs [][]byte
+	for _, level := range []int{0, 3, 4, 9} {
+		buf := &bytes.Buffer{}
+		if err := copyCompressed(context.Background(), buf, bytes.NewReader(input.Bytes()), xzCommand(level)); err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, buf.Bytes())
+	}
+	// The presets differ in more than the dictionary size
+	if bytes.Equal(outputs[1], outputs[2]) {
+		t.Error("expected xz levels 3 and 4 to differ")
+	}
+}
+
+func TestCopyCompressedFailure(t *testing.T) {
+	err := copyCompressed(context.Background(), ioutil.Discard, bytes.NewReader(nil), exec.Command("sh", "-c", "exit 3"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSetArchiveCompression(t *testing.T) {
+	defer SetArchiveCompression(DefaultArchiveCompression)
+
+	for _, c := range []ArchiveCompression{
+		{Gzip: 0, Bzip2: 9, Xz: 6, Zstd: 3},
+		{Gzip: 6, Bzip2: 10, Xz: 6, Zstd: 3},
+		{Gzip: 6, Bzip2: 9, Xz: 10, Zstd: 3},
+		{Gzip: 6, Bzip2: 9, Xz: 6, Zstd: 23},
+	} {
+		if err := SetArchiveCompression(c); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+
+	c := ArchiveCompression{Gzip: 1, Bzip2: 1, Xz: 0, Zstd: 1}
+	if err := SetArchiveCompression(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentArchiveCompression(); got != c {
+		t.Fatalf("expected %+v, got %+v", c, got)
+	}
+}
+
+func decompressCommand(b []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(b)
+	return cmd.Output()
+}
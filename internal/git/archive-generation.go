@@ -0,0 +1,229 @@
+/*
+In this file we share one 'git archive' run between all requests for the
+same archive
+*/
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// archiveGenerator writes an archive to w. It runs in its own goroutine.
+type archiveGenerator func(ctx context.Context, w io.Writer) error
+
+// archiveGeneration writes an archive into a tempfile, which requests read
+// while it grows. When it is complete the tempfile becomes the cached
+// archive.
+type archiveGeneration struct {
+	archivePath string
+	tempFile    *os.File
+	cancel      context.CancelFunc
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	size    int64
+	done    bool
+	err     error
+	readers int
+	// sums holds the checksums of the archive once it is complete
+	sums archiveSums
+}
+
+// The running generations, by archive path
+var archiveGenerations = struct {
+	sync.Mutex
+	m map[string]*archiveGeneration
+}{m: make(map[string]*archiveGeneration)}
+
+// openArchiveGeneration returns a reader of the archive at archivePath as it
+// is being generated. If no request is generating it yet, generate is
+// started. Reads stop waiting for more of the archive when ctx is done.
+func openArchiveGeneration(ctx context.Context, archivePath string, generate archiveGenerator) (*archiveGenerationReader, error) {
+	archiveGenerations.Lock()
+	defer archiveGenerations.Unlock()
+
+	g := archiveGenerations.m[archivePath]
+	if g == nil {
+		// We assume the tempFile has a unique name so that concurrent
+		// generations are safe. We create the tempfile in the same directory
+		// as the final cached archive we want to create so that we can use an
+		// atomic link(2) operation to finalize the cached archive.
+		tempFile, err := prepareArchiveTempfile(path.Dir(archivePath), path.Base(archivePath))
+		if err != nil {
+			return nil, fmt.Errorf("create tempfile: %v", err)
+		}
+
+		// The generation does not stop with the request that started it, but
+		// when nobody reads it anymore
+		genCtx, cancel := context.WithCancel(context.Background())
+		g = &archiveGeneration{archivePath: archivePath, tempFile: tempFile, cancel: cancel}
+		g.cond = sync.NewCond(&g.mu)
+		archiveGenerations.m[archivePath] = g
+
+		go g.run(genCtx, generate)
+	}
+
+	// Each reader has its own file offset
+	file, err := os.Open(g.tempFile.Name())
+	if err != nil {
+		g.mu.Lock()
+		if g.readers == 0 {
+			g.cancel()
+			delete(archiveGenerations.m, archivePath)
+		}
+		g.mu.Unlock()
+		return nil, fmt.Errorf("open tempfile: %v", err)
+	}
+
+	g.mu.Lock()
+	g.readers++
+	g.mu.Unlock()
+
+	r := &archiveGenerationReader{g: g, file: file, ctx: ctx}
+	r.stopWake = afterFunc(ctx, func() {
+		g.mu.Lock()
+		g.cond.Broadcast()
+		g.mu.Unlock()
+	})
+	return r, nil
+}
+
+func (g *archiveGeneration) run(ctx context.Context, generate archiveGenerator) {
+	defer g.cancel()
+
+	hasher := newArchiveHasher()
+	err := generate(ctx, io.MultiWriter(&archiveGenerationWriter{g}, hasher))
+	sums := hasher.sums()
+	if err == nil {
+		if finalizeErr := finalizeCachedArchive(g.tempFile, g.archivePath); finalizeErr != nil {
+			err = fmt.Errorf("finalize cached archive: %v", finalizeErr)
+		} else {
+			// Requests that find the archive without checksum files compute
+			// them, so the archive is still good if this fails
+			if checksumErr := writeCachedArchiveChecksums(g.archivePath, g.tempFile.Name(), sums); checksumErr != nil {
+				helper.LogError(nil, fmt.Errorf("archive generation: write checksums of %q: %v", g.archivePath, checksumErr))
+			}
+			archiveCache.add(g.archivePath)
+		}
+	}
+
+	// New requests open the cached archive, or start over if err != nil
+	archiveGenerations.Lock()
+	if archiveGenerations.m[g.archivePath] == g {
+		delete(archiveGenerations.m, g.archivePath)
+	}
+	archiveGenerations.Unlock()
+
+	g.mu.Lock()
+	g.done = true
+	g.err = err
+	g.sums = sums
+	g.cond.Broadcast()
+	g.mu.Unlock()
+
+	// Readers have the tempfile open, so they can finish reading it
+	g.tempFile.Close()
+	os.Remove(g.tempFile.Name())
+}
+
+type archiveGenerationWriter struct{ g *archiveGeneration }
+
+func (w *archiveGenerationWriter) Write(p []byte) (int, error) {
+	n, err := w.g.tempFile.Write(p)
+
+	w.g.mu.Lock()
+	w.g.size += int64(n)
+	w.g.cond.Broadcast()
+	w.g.mu.Unlock()
+
+	return n, err
+}
+
+// archiveGenerationReader reads an archive up to the point it has been
+// generated, and waits for more.
+type archiveGenerationReader struct {
+	g      *archiveGeneration
+	file   *os.File
+	offset int64
+	// Waiting readers are woken up when ctx is done
+	ctx      context.Context
+	stopWake func() bool
+}
+
+func (r *archiveGenerationReader) Read(p []byte) (int, error) {
+	g := r.g
+
+	g.mu.Lock()
+	for r.offset >= g.size && !g.done && r.ctx.Err() == nil {
+		g.cond.Wait()
+	}
+	size, done, err := g.size, g.done, g.err
+	g.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if r.offset >= size && !done {
+		return 0, r.ctx.Err()
+	}
+	if r.offset >= size {
+		return 0, io.EOF
+	}
+
+	if available := size - r.offset; int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// generationError returns the error of the generation, if it failed
+func (r *archiveGenerationReader) generationError() error {
+	r.g.mu.Lock()
+	defer r.g.mu.Unlock()
+	return r.g.err
+}
+
+// checksums returns the checksums of the archive. They are only known
+// after Read returned io.EOF.
+func (r *archiveGenerationReader) checksums() archiveSums {
+	r.g.mu.Lock()
+	defer r.g.mu.Unlock()
+	return r.g.sums
+}
+
+// Close detaches the reader from the generation. When the last reader goes
+// away before the archive is complete, nobody is waiting for it and the
+// generation stops.
+func (r *archiveGenerationReader) Close() error {
+	g := r.g
+	r.stopWake()
+
+	archiveGenerations.Lock()
+	defer archiveGenerations.Unlock()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.readers--
+	if g.readers == 0 && !g.done {
+		g.cancel()
+		// Do not let new requests attach to a cancelled generation
+		if archiveGenerations.m[g.archivePath] == g {
+			delete(archiveGenerations.m, g.archivePath)
+		}
+	}
+
+	return r.file.Close()
+}
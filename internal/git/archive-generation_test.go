@@ -0,0 +1,193 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestArchiveGenerationIsShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := path.Join(dir, "archive.tar")
+
+	proceed := make(chan struct{})
+	generations := 0
+	generate := func(ctx context.Context, w io.Writer) error {
+		generations++
+		if _, err := w.Write([]byte("first ")); err != nil {
+			return err
+		}
+		<-proceed
+		_, err := w.Write([]byte("second"))
+		return err
+	}
+
+	var readers []*archiveGenerationReader
+	for i := 0; i < 3; i++ {
+		r, err := openArchiveGeneration(context.Background(), archivePath, generate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, r)
+	}
+
+	// Readers get the bytes generated so far, before the generation is done
+	buf := make([]byte, 100)
+	n, err := readers[0].Read(buf)
+	if err != nil || string(buf[:n]) != "first " {
+		t.Fatalf("expected %q, got %q, %v", "first ", buf[:n], err)
+	}
+	close(proceed)
+
+	var wg sync.WaitGroup
+	outputs := make([][]byte, len(readers))
+	for i, r := range readers {
+		wg.Add(1)
+		go func(i int, r *archiveGenerationReader) {
+			defer wg.Done()
+			defer r.Close()
+			outputs[i], _ = ioutil.ReadAll(r)
+		}(i, r)
+	}
+	wg.Wait()
+
+	if generations != 1 {
+		t.Fatalf("expected 1 generation, got %d", generations)
+	}
+	if string(outputs[0]) != "second" {
+		t.Fatalf("expected %q, got %q", "second", outputs[0])
+	}
+	for _, output := range outputs[1:] {
+		if string(output) != "first second" {
+			t.Fatalf("expected %q, got %q", "first second", output)
+		}
+	}
+
+	cached, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cached) != "first second" {
+		t.Fatalf("expected cached archive %q, got %q", "first second", cached)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	if expected := []string{"archive.tar", "archive.tar.sha256", "archive.tar.sha512"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %q in %s, found %q", expected, dir, names)
+	}
+}
+
+func TestArchiveGenerationError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := path.Join(dir, "archive.tar")
+
+	generateErr := errors.New("generation failed")
+	r, err := openArchiveGeneration(context.Background(), archivePath, func(ctx context.Context, w io.Writer) error {
+		w.Write([]byte("partial"))
+		return generateErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := ioutil.ReadAll(r); err != generateErr {
+		t.Fatalf("expected %v, got %v", generateErr, err)
+	}
+	if r.generationError() != generateErr {
+		t.Fatalf("expected generationError %v, got %v", generateErr, r.generationError())
+	}
+	if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+		t.Fatalf("expected no cached archive, got %v", err)
+	}
+}
+
+func TestArchiveGenerationStopsWithoutReaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := path.Join(dir, "archive.tar")
+
+	stopped := make(chan error)
+	r, err := openArchiveGeneration(context.Background(), archivePath, func(ctx context.Context, w io.Writer) error {
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Close()
+	if err := <-stopped; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	// A new request starts a new generation
+	next, err := openArchiveGeneration(context.Background(), archivePath, func(ctx context.Context, w io.Writer) error {
+		_, err := w.Write([]byte("archive"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	if output, err := ioutil.ReadAll(next); err != nil || !bytes.Equal(output, []byte("archive")) {
+		t.Fatalf("expected %q, got %q, %v", "archive", output, err)
+	}
+}
+
+func TestArchiveGenerationReaderCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := path.Join(dir, "archive.tar")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := openArchiveGeneration(ctx, archivePath, func(ctx context.Context, w io.Writer) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The reader is waiting for the generation when the request goes away
+	readErr := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		readErr <- err
+	}()
+	cancel()
+
+	if err := <-readErr; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+In this file we put the content of git lfs objects in archives, instead of
+their pointer files
+*/
+
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+)
+
+// What to do when the object of a pointer file is not in the LFS storage
+const (
+	lfsMissingError   = "error"   // Fail the archive
+	lfsMissingPointer = "pointer" // Keep the pointer file
+)
+
+func validLfsMissingPolicy(policy string) bool {
+	return policy == lfsMissingError || policy == lfsMissingPointer
+}
+
+// archivePathWithLfs returns where to cache the archive with LFS content.
+// It depends on the policy for missing objects and on the objects of the
+// project.
+func archivePathWithLfs(archivePath string, missingPolicy string, objects lfsObjectSet) string {
+	oids := make([]string, 0, len(objects))
+	for oid := range objects {
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+	hash := sha1.Sum([]byte(strings.Join(oids, "\n")))
+
+	dir, base := path.Split(archivePath)
+	return path.Join(dir, fmt.Sprintf("lfs-%s-%x", missingPolicy, hash), base)
+}
+
+// lfsObjectSet holds the LFS objects that GitLab has linked to a project.
+// Projects share the LFS storage, so a pointer file must not give access to
+// objects of other projects: it stays a pointer file, whatever the policy
+// for missing objects.
+type lfsObjectSet map[string]bool
+
+func newLfsObjectSet(oids []string) (lfsObjectSet, error) {
+	objects := make(lfsObjectSet, len(oids))
+	for _, oid := range oids {
+		if !lfs.ValidOid(oid) {
+			return nil, fmt.Errorf("invalid lfs object %q", oid)
+		}
+		objects[oid] = true
+	}
+	return objects, nil
+}
+
+// missingLfsObjects returns the objects that are not in storagePath. We
+// check this before the archive is generated so that the request can still
+// fail. An object that goes missing while we write the archive cuts the
+// response short.
+func missingLfsObjects(storagePath string, objects lfsObjectSet) ([]string, error) {
+	var missing []string
+	for oid := range objects {
+		_, err := os.Stat((&lfs.Pointer{Oid: oid}).ObjectPath(storagePath))
+		if os.IsNotExist(err) {
+			missing = append(missing, oid)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// archiveEntryWriter writes the entries of a tar archive in some archive
+// format
+type archiveEntryWriter interface {
+	globalHeader(hdr *tar.Header) error
+	entry(hdr *tar.Header, r io.Reader) error
+	Close() error
+}
+
+// rewriteLfsPointers reads the tar output of 'git archive' from src and
+// writes it to dst as a tar or zip archive, with pointer files to objects
+// replaced by their content under storagePath.
+func rewriteLfsPointers(dst io.Writer, src io.Reader, format string, storagePath string, objects lfsObjectSet, missingPolicy string) error {
+	var out archiveEntryWriter
+	if format == "zip" {
+		out = &zipEntryWriter{zip.NewWriter(dst)}
+	} else {
+		out = &tarEntryWriter{tar.NewWriter(dst)}
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read 'git archive' output: %v", err)
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if err := out.globalHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if hdr.Typeflag != tar.TypeReg || hdr.Size >= lfs.MaxPointerSize {
+			if err := out.entry(hdr, tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("read 'git archive' output: %v", err)
+		}
+		pointer, ok := lfs.ParsePointer(data)
+		if !ok || !objects[pointer.Oid] {
+			if err := out.entry(hdr, bytes.NewReader(data)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		object, err := pointer.Open(storagePath)
+		if err != nil {
+			if os.IsNotExist(err) && missingPolicy == lfsMissingPointer {
+				if err := out.entry(hdr, bytes.NewReader(data)); err != nil {
+					return err
+				}
+				continue
+			}
+			if os.IsNotExist(err) {
+				return fmt.Errorf("lfs object %s of %q is missing", pointer.Oid, hdr.Name)
+			}
+			return fmt.Errorf("lfs object %s of %q: %v", pointer.Oid, hdr.Name, err)
+		}
+
+		hdr.Size = pointer.Size
+		err = out.entry(hdr, pointer.VerifyReader(object))
+		object.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+type tarEntryWriter struct{ *tar.Writer }
+
+func (t *tarEntryWriter) globalHeader(hdr *tar.Header) error {
+	return t.WriteHeader(hdr)
+}
+
+func (t *tarEntryWriter) entry(hdr *tar.Header, r io.Reader) error {
+	if err := t.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(t, r)
+	return err
+}
+
+type zipEntryWriter struct{ *zip.Writer }
+
+// 'git archive --format=zip' puts the commit ID in the archive comment,
+// and 'git archive --format=tar' in the global header
+func (z *zipEntryWriter) globalHeader(hdr *tar.Header) error {
+	if comment, ok := hdr.PAXRecords["comment"]; ok {
+		return z.SetComment(comment)
+	}
+	return nil
+}
+
+func (z *zipEntryWriter) entry(hdr *tar.Header, r io.Reader) error {
+	fh := &zip.FileHeader{Name: hdr.Name, Method: zip.Deflate, Modified: hdr.ModTime}
+	fh.SetMode(hdr.FileInfo().Mode())
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		fh.Method = zip.Store
+		if !strings.HasSuffix(fh.Name, "/") {
+			fh.Name += "/"
+		}
+	case tar.TypeSymlink:
+		// Like in 'git archive --format=zip' the content is the target
+		fh.Method = zip.Store
+		r = strings.NewReader(hdr.Linkname)
+	}
+
+	w, err := z.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,203 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+)
+
+func lfsPointerFile(content string) (string, *lfs.Pointer) {
+	sum := sha256.Sum256([]byte(content))
+	p := &lfs.Pointer{Oid: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	return fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", p.Oid, p.Size), p
+}
+
+func setupLfsArchiveRepo(t *testing.T, dir string) (*archiveParams, string, string) {
+	repo := filepath.Join(dir, "repo")
+	storage := filepath.Join(dir, "lfs-objects")
+	runGit(t, dir, nil, "init", "-q", repo)
+
+	pointer, p := lfsPointerFile("large file content\n")
+	missingPointer, missing := lfsPointerFile("missing content\n")
+	otherPointer, other := lfsPointerFile("other project content\n")
+	files := map[string]string{
+		"README":      "readme\n",
+		"large.bin":   pointer,
+		"missing.bin": missingPointer,
+		"other.bin":   otherPointer,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(repo, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runGit(t, repo, nil, "add", ".")
+	runGit(t, repo, nil, "commit", "-q", "-m", "initial")
+
+	// The object of other.bin is in the storage, but belongs to another
+	// project
+	for object, content := range map[*lfs.Pointer]string{p: "large file content\n", other: "other project content\n"} {
+		objectPath := object.ObjectPath(storage)
+		os.MkdirAll(filepath.Dir(objectPath), 0755)
+		if err := ioutil.WriteFile(objectPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &archiveParams{
+		RepoPath:        filepath.Join(repo, ".git"),
+		ArchivePrefix:   "project",
+		CommitId:        "HEAD",
+		IncludeLfsBlobs: true,
+		LfsStoragePath:  storage,
+		LfsOids:         []string{p.Oid, missing.Oid},
+		LfsMissing:      lfsMissingPointer,
+	}, missingPointer, otherPointer
+}
+
+func readTestArchive(t *testing.T, format string, data []byte) (map[string]string, string) {
+	files := make(map[string]string)
+	comment := ""
+
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		comment = zr.Comment
+		for _, f := range zr.File {
+			if strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = string(content)
+		}
+		return files, comment
+	}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			comment = hdr.PAXRecords["comment"]
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(content)
+	}
+	return files, comment
+}
+
+func TestArchiveWithLfsBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params, missingPointer, otherPointer := setupLfsArchiveRepo(t, dir)
+	lfsObjects, err := newLfsObjectSet(params.LfsOids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitID := strings.TrimSpace(string(runGit(t, dir, nil, "--git-dir="+params.RepoPath, "rev-parse", "HEAD")))
+
+	expected := map[string]string{
+		"project/README":      "readme\n",
+		"project/large.bin":   "large file content\n",
+		"project/missing.bin": missingPointer,
+		"project/other.bin":   otherPointer,
+	}
+	for _, format := range []string{"tar", "zip"} {
+		out := &bytes.Buffer{}
+		if err := generateArchive(context.Background(), out, params, lfsObjects, nil, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		files, comment := readTestArchive(t, format, out.Bytes())
+		if !reflect.DeepEqual(files, expected) {
+			t.Errorf("%s: expected %q, got %q", format, expected, files)
+		}
+		if comment != commitID {
+			t.Errorf("%s: expected comment %q, got %q", format, commitID, comment)
+		}
+	}
+
+	params.LfsMissing = lfsMissingError
+	err = generateArchive(context.Background(), ioutil.Discard, params, lfsObjects, nil, "tar")
+	if err == nil || !strings.Contains(err.Error(), `of "project/missing.bin" is missing`) {
+		t.Fatalf("expected a missing object error, got %v", err)
+	}
+}
+
+func TestArchivePathWithLfs(t *testing.T) {
+	objects := lfsObjectSet{strings.Repeat("a", 64): true, strings.Repeat("b", 64): true}
+	out := archivePathWithLfs("/cache/project-master.zip", lfsMissingPointer, objects)
+	if !strings.HasPrefix(out, "/cache/lfs-pointer-") || !strings.HasSuffix(out, "/project-master.zip") {
+		t.Fatalf("unexpected archive path %q", out)
+	}
+
+	// Archives with other objects are cached elsewhere
+	delete(objects, strings.Repeat("b", 64))
+	if other := archivePathWithLfs("/cache/project-master.zip", lfsMissingPointer, objects); other == out {
+		t.Fatalf("expected another archive path than %q", out)
+	}
+}
+
+func TestMissingLfsObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params, _, _ := setupLfsArchiveRepo(t, dir)
+	objects, err := newLfsObjectSet(params.LfsOids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := missingLfsObjects(params.LfsStoragePath, objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != params.LfsOids[1] {
+		t.Fatalf("expected %s to be missing, got %v", params.LfsOids[1], missing)
+	}
+
+	if _, err := newLfsObjectSet([]string{"../../etc/passwd"}); err == nil {
+		t.Fatal("expected an invalid object ID to be rejected")
+	}
+}
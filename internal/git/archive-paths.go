@@ -0,0 +1,104 @@
+/*
+In this file we handle archives of some paths of a repository, e.g. only
+its docs/ directory
+*/
+
+package git
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Keep the file name of archives of many paths within filesystem limits
+const maxArchivePathsSlug = 100
+
+// We read the objects of paths up to this size, so that their 'git
+// cat-file --batch' process can be reused
+const maxArchivePathDrain = 1 << 20
+
+// cleanArchivePaths validates the paths that an archive is limited to. The
+// result is sorted so that it can be part of the cache key.
+func cleanArchivePaths(paths []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var cleaned []string
+	for _, p := range paths {
+		// The paths end up in the file name of the Content-Disposition
+		// header, where control characters are not allowed
+		if p == "" || strings.IndexFunc(p, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("invalid path %q", p)
+		}
+		if path.IsAbs(p) {
+			return nil, fmt.Errorf("absolute path %q", p)
+		}
+
+		c := path.Clean(p)
+		if c == "." || c == ".." || strings.HasPrefix(c, "../") {
+			return nil, fmt.Errorf("path %q is outside the repository", p)
+		}
+		if strings.HasPrefix(c, "-") {
+			return nil, fmt.Errorf("path %q looks like an option", p)
+		}
+
+		if !seen[c] {
+			seen[c] = true
+			cleaned = append(cleaned, c)
+		}
+	}
+
+	sort.Strings(cleaned)
+	return cleaned, nil
+}
+
+// archivePathWithPaths returns where to cache the archive of paths. The file
+// name mentions the paths, e.g. project-master-docs.tar.gz, and a
+// directory named after a hash of the paths keeps the cache key unique.
+func archivePathWithPaths(archivePath string, paths []string) string {
+	dir, base := path.Split(archivePath)
+
+	ext := path.Ext(base)
+	for _, tarExt := range []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tar.zst"} {
+		if strings.HasSuffix(base, tarExt) {
+			ext = tarExt
+			break
+		}
+	}
+
+	// Quotes and backslashes would end the quoted file name in the
+	// Content-Disposition header, or escape its next character
+	slug := strings.NewReplacer("/", "-", `"`, "-", `\`, "-").Replace(strings.Join(paths, "-"))
+	if len(slug) > maxArchivePathsSlug {
+		slug = slug[:maxArchivePathsSlug]
+	}
+
+	hash := sha1.Sum([]byte(strings.Join(paths, "\x00")))
+	return path.Join(dir, fmt.Sprintf("paths-%x", hash), strings.TrimSuffix(base, ext)+"-"+slug+ext)
+}
+
+// missingArchivePaths returns the paths that do not exist in commit
+func missingArchivePaths(ctx context.Context, env []string, params *archiveParams) ([]string, error) {
+	var missing []string
+	for _, p := range params.Paths {
+		object, err := catFileBatch.open(ctx, env, params.RepoPath, params.CommitId+":"+p)
+		if err == errObjectMissing {
+			missing = append(missing, p)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The process is only reused if we read the whole object
+		if object.Size <= maxArchivePathDrain {
+			io.Copy(ioutil.Discard, object)
+		}
+		object.Close()
+	}
+	return missing, nil
+}
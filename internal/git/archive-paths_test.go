@@ -0,0 +1,137 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCleanArchivePaths(t *testing.T) {
+	paths, err := cleanArchivePaths([]string{"src/", "docs", "./docs/api/../", "a b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a b", "docs", "src"}; !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected %q, got %q", expected, paths)
+	}
+
+	for _, p := range []string{"", ".", "..", "../etc", "docs/../../etc", "/etc", "a\x00b", "a\nb", "a\rb", "a\x1bb", "a\x7fb", "a\u0085b", "--output=/tmp/x", "./-v"} {
+		if _, err := cleanArchivePaths([]string{p}); err == nil {
+			t.Errorf("expected %q to be rejected", p)
+		}
+	}
+}
+
+func TestArchivePathWithPaths(t *testing.T) {
+	for _, testCase := range []struct {
+		archivePath string
+		paths       []string
+		name        string
+	}{
+		{"/cache/project-master.tar.gz", []string{"docs"}, "project-master-docs.tar.gz"},
+		{"/cache/project-master.zip", []string{"docs/api", "src"}, "project-master-docs-api-src.zip"},
+		{"/cache/project-master.tar", []string{"docs"}, "project-master-docs.tar"},
+		{"/cache/project-master.zip", []string{`a\b`, `say "hi"`}, "project-master-a-b-say -hi-.zip"},
+	} {
+		out := archivePathWithPaths(testCase.archivePath, testCase.paths)
+		if filepath.Base(out) != testCase.name {
+			t.Errorf("expected file name %q, got %q", testCase.name, filepath.Base(out))
+		}
+		if filepath.Dir(filepath.Dir(out)) != "/cache" {
+			t.Errorf("expected %q to be in a subdirectory of /cache", out)
+		}
+	}
+
+	// Different paths with the same file name are cached separately
+	a := archivePathWithPaths("/cache/archive.zip", []string{"a-b"})
+	b := archivePathWithPaths("/cache/archive.zip", []string{"a/b"})
+	if a == b {
+		t.Fatalf("expected different cache paths, got %q twice", a)
+	}
+}
+
+func TestArchivePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	runGit(t, dir, nil, "init", "-q", repo)
+	for _, name := range []string{"README", "docs/index.md", "docs/api/*.md", "src/main.go"} {
+		os.MkdirAll(filepath.Join(repo, filepath.Dir(name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(repo, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runGit(t, repo, nil, "add", ".")
+	runGit(t, repo, nil, "commit", "-q", "-m", "initial")
+
+	params := &archiveParams{
+		RepoPath:      filepath.Join(repo, ".git"),
+		ArchivePrefix: "project",
+		CommitId:      "HEAD",
+		Paths:         []string{"docs/api/*.md", "src", "missing"},
+	}
+	missing, err := missingArchivePaths(context.Background(), nil, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(missing, []string{"missing"}) {
+		t.Fatalf("expected only %q to be missing, got %q", "missing", missing)
+	}
+
+	// The * is not a wildcard
+	params.Paths = []string{"docs/api/*.md", "src"}
+	expected := []string{"project/docs/api/*.md", "project/src/main.go"}
+
+	tarball := &bytes.Buffer{}
+	if err := generateArchive(context.Background(), tarball, params, nil, nil, "tar"); err != nil {
+		t.Fatal(err)
+	}
+	var tarFiles []string
+	tr := tar.NewReader(tarball)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tarFiles = append(tarFiles, hdr.Name)
+		}
+	}
+
+	zipball := &bytes.Buffer{}
+	if err := generateArchive(context.Background(), zipball, params, nil, nil, "zip"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipball.Bytes()), int64(zipball.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zipFiles []string
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			zipFiles = append(zipFiles, f.Name)
+		}
+	}
+
+	if !reflect.DeepEqual(tarFiles, expected) {
+		t.Errorf("tar: expected %q, got %q", expected, tarFiles)
+	}
+	if !reflect.DeepEqual(zipFiles, expected) {
+		t.Errorf("zip: expected %q, got %q", expected, zipFiles)
+	}
+}
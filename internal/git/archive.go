@@ -5,6 +5,7 @@ In this file we handle 'git archive' downloads
 package git
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,7 +15,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
-	"syscall"
+	"strings"
 	"time"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
@@ -27,6 +28,17 @@ type archiveParams struct {
 	ArchivePath   string
 	ArchivePrefix string
 	CommitId      string
+	GitEnv        map[string]string
+	// Paths limits the archive to some files or directories
+	Paths []string
+	// IncludeLfsBlobs replaces LFS pointer files with the objects in
+	// LfsStoragePath, if they are in LfsOids, the objects of the project.
+	// LfsMissing says what to do if one of these is missing: "error" (the
+	// default) or "pointer".
+	IncludeLfsBlobs bool
+	LfsStoragePath  string
+	LfsOids         []string
+	LfsMissing      string
 }
 
 var SendArchive = &archive{"git-archive:"}
@@ -40,18 +52,63 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 
 	var format string
 	urlPath := r.URL.Path
-	format, ok := parseBasename(filepath.Base(urlPath))
+	basename, checksum := splitChecksumSuffix(filepath.Base(urlPath))
+	format, ok := parseBasename(basename)
 	if !ok {
 		helper.Fail500(w, r, fmt.Errorf("SendArchive: invalid format: %s", urlPath))
 		return
 	}
 
+	if len(params.Paths) > 0 {
+		paths, err := cleanArchivePaths(params.Paths)
+		if err != nil {
+			helper.HTTPError(w, r, err.Error(), 400)
+			return
+		}
+		params.Paths = paths
+		params.ArchivePath = archivePathWithPaths(params.ArchivePath, paths)
+	}
+
+	var lfsObjects lfsObjectSet
+	if params.IncludeLfsBlobs {
+		var err error
+		if params.LfsStoragePath == "" {
+			helper.Fail500(w, r, fmt.Errorf("SendArchive: LfsStoragePath empty"))
+			return
+		}
+		if params.LfsMissing == "" {
+			params.LfsMissing = lfsMissingError
+		}
+		if !validLfsMissingPolicy(params.LfsMissing) {
+			helper.Fail500(w, r, fmt.Errorf("SendArchive: invalid LfsMissing: %q", params.LfsMissing))
+			return
+		}
+		if lfsObjects, err = newLfsObjectSet(params.LfsOids); err != nil {
+			helper.Fail500(w, r, fmt.Errorf("SendArchive: %v", err))
+			return
+		}
+		params.ArchivePath = archivePathWithLfs(params.ArchivePath, params.LfsMissing, lfsObjects)
+	}
+
 	archiveFilename := path.Base(params.ArchivePath)
 
-	if cachedArchive, err := os.Open(params.ArchivePath); err == nil {
+	if cachedArchive, release, err := archiveCache.open(params.ArchivePath); err == nil {
+		defer release()
 		defer cachedArchive.Close()
+
+		sums, err := cachedArchiveChecksums(params.ArchivePath, cachedArchive)
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("SendArchive: checksums: %v", err))
+			return
+		}
+		if checksum != nil {
+			serveArchiveChecksum(w, checksum, sums, archiveFilename)
+			return
+		}
+
 		log.Printf("Serving cached file %q", params.ArchivePath)
 		setArchiveHeaders(w, format, archiveFilename)
+		w.Header().Set("Digest", digestHeader(sums))
 		// Even if somebody deleted the cachedArchive from disk since we opened
 		// the file, Unix file semantics guarantee we can still read from the
 		// open file in this process.
@@ -59,81 +116,128 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 		return
 	}
 
-	// We assume the tempFile has a unique name so that concurrent requests are
-	// safe. We create the tempfile in the same directory as the final cached
-	// archive we want to create so that we can use an atomic link(2) operation
-	// to finalize the cached archive.
-	tempFile, err := prepareArchiveTempfile(path.Dir(params.ArchivePath), archiveFilename)
+	env, err := gitEnv(params.GitEnv)
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendArchive: create tempfile: %v", err))
+		helper.Fail500(w, r, fmt.Errorf("SendArchive: %v", err))
 		return
 	}
-	defer tempFile.Close()
-	defer os.Remove(tempFile.Name())
 
-	compressCmd, archiveFormat := parseArchiveFormat(format)
-
-	archiveCmd := gitCommand("", "git", "--git-dir="+params.RepoPath, "archive", "--format="+archiveFormat, "--prefix="+params.ArchivePrefix+"/", params.CommitId)
-	archiveStdout, err := archiveCmd.StdoutPipe()
-	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendArchive: archive stdout: %v", err))
-		return
-	}
-	defer archiveStdout.Close()
-	if err := archiveCmd.Start(); err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendArchive: start %v: %v", archiveCmd.Args, err))
-		return
+	if len(params.Paths) > 0 {
+		// Otherwise 'git archive' fails before it writes anything, and we can
+		// only tell the client about a server error
+		missing, err := missingArchivePaths(r.Context(), env, &params)
+		if err != nil {
+			helper.Fail500(w, r, helper.PrefixError("SendArchive: check paths", err))
+			return
+		}
+		if len(missing) > 0 {
+			http.Error(w, fmt.Sprintf("Path not found: %s", strings.Join(missing, ", ")), 404)
+			return
+		}
 	}
-	defer helper.CleanUpProcessGroup(archiveCmd) // Ensure brute force subprocess clean-up
 
-	var stdout io.ReadCloser
-	if compressCmd == nil {
-		stdout = archiveStdout
-	} else {
-		compressCmd.Stdin = archiveStdout
-		compressCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-		stdout, err = compressCmd.StdoutPipe()
+	if params.IncludeLfsBlobs && params.LfsMissing == lfsMissingError {
+		missing, err := missingLfsObjects(params.LfsStoragePath, lfsObjects)
 		if err != nil {
-			helper.Fail500(w, r, fmt.Errorf("SendArchive: compress stdout: %v", err))
+			helper.Fail500(w, r, fmt.Errorf("SendArchive: check lfs objects: %v", err))
+			return
+		}
+		if len(missing) > 0 {
+			helper.Fail500(w, r, fmt.Errorf("SendArchive: missing lfs objects: %s", strings.Join(missing, ", ")))
 			return
 		}
-		defer stdout.Close()
+	}
+
+	generate := func(ctx context.Context, out io.Writer) error {
+		return generateArchive(ctx, out, &params, lfsObjects, env, format)
+	}
+	archive, err := openArchiveGeneration(r.Context(), params.ArchivePath, generate)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendArchive: %v", err))
+		return
+	}
+	defer archive.Close()
 
-		if err := compressCmd.Start(); err != nil {
-			helper.Fail500(w, r, fmt.Errorf("SendArchive: start %v: %v", compressCmd.Args, err))
+	if checksum != nil {
+		// The checksums are known once the archive is complete
+		if _, err := io.Copy(ioutil.Discard, archive); err != nil {
+			helper.Fail500(w, r, helper.PrefixError("SendArchive", err))
 			return
 		}
-		defer helper.CleanUpProcessGroup(compressCmd)
+		serveArchiveChecksum(w, checksum, archive.checksums(), archiveFilename)
+		return
+	}
 
-		archiveStdout.Close()
+	// Wait for the first bytes, so that we can still respond with an error
+	// if 'git archive' fails right away
+	buf := make([]byte, 32*1024)
+	n, err := archive.Read(buf)
+	if err != nil && err != io.EOF {
+		helper.Fail500(w, r, helper.PrefixError("SendArchive", err))
+		return
 	}
-	// Every Read() from stdout will be synchronously written to tempFile
-	// before it comes out the TeeReader.
-	archiveReader := io.TeeReader(stdout, tempFile)
 
 	// Start writing the response
 	setArchiveHeaders(w, format, archiveFilename)
+	w.Header().Set("Trailer", "Digest")
 	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
-	if _, err := io.Copy(w, archiveReader); err != nil {
-		helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy 'git archive' output: %v", err)})
+	if _, err := w.Write(buf[:n]); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy archive: %v", err)})
 		return
 	}
-	if err := archiveCmd.Wait(); err != nil {
-		helper.LogError(r, fmt.Errorf("SendArchive: archiveCmd: %v", err))
+	if _, err := io.Copy(w, archive); err != nil {
+		if genErr := archive.generationError(); genErr != nil {
+			helper.LogError(r, helper.PrefixError("SendArchive", genErr))
+		} else {
+			helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy archive: %v", err)})
+		}
 		return
 	}
-	if compressCmd != nil {
-		if err := compressCmd.Wait(); err != nil {
-			helper.LogError(r, fmt.Errorf("SendArchive: compressCmd: %v", err))
-			return
-		}
+	w.Header().Set("Digest", digestHeader(archive.checksums()))
+}
+
+// generateArchive writes the output of 'git archive', compressed for
+// format, to w
+func generateArchive(ctx context.Context, w io.Writer, params *archiveParams, lfsObjects lfsObjectSet, env []string, format string) error {
+	compressCmd, archiveFormat := parseArchiveFormat(format, currentArchiveCompression())
+	if params.IncludeLfsBlobs {
+		// We write zip archives ourselves, from the tar entries
+		archiveFormat = "tar"
 	}
 
-	if err := finalizeCachedArchive(tempFile, params.ArchivePath); err != nil {
-		helper.LogError(r, fmt.Errorf("SendArchive: finalize cached archive: %v", err))
-		return
+	// Paths are not pathspecs: "*" and ":(exclude)" have no special meaning
+	args := []string{"--git-dir=" + params.RepoPath, "--literal-pathspecs", "archive", "--format=" + archiveFormat, "--prefix=" + params.ArchivePrefix + "/", params.CommitId}
+	args = append(append(args, "--"), params.Paths...)
+	archiveCmd := gitCommand("", env, "git", args...)
+	archiveStdout, err := archiveCmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("archive stdout: %v", err)
+	}
+	defer archiveStdout.Close()
+	helper.LimitProcess("archive", archiveCmd)
+	if err := archiveCmd.Start(); err != nil {
+		return fmt.Errorf("start %v: %v", archiveCmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(archiveCmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(ctx, "archive", archiveCmd)()
+
+	var archiveOutput io.Reader = archiveStdout
+	if params.IncludeLfsBlobs {
+		lfsReader, lfsWriter := io.Pipe()
+		defer lfsReader.Close()
+		go func() {
+			lfsWriter.CloseWithError(rewriteLfsPointers(lfsWriter, archiveStdout, format, params.LfsStoragePath, lfsObjects, params.LfsMissing))
+		}()
+		archiveOutput = lfsReader
 	}
+
+	if err := copyCompressed(ctx, w, archiveOutput, compressCmd); err != nil {
+		return helper.PrefixError("copy 'git archive' output", err)
+	}
+	if err := archiveCmd.Wait(); err != nil {
+		return helper.NewProcessError(archiveCmd, fmt.Errorf("archiveCmd: %v", err))
+	}
+	return nil
 }
 
 func setArchiveHeaders(w http.ResponseWriter, format string, archiveFilename string) {
@@ -148,25 +252,37 @@ func setArchiveHeaders(w http.ResponseWriter, format string, archiveFilename str
 	w.Header().Set("Cache-Control", "private")
 }
 
-func parseArchiveFormat(format string) (*exec.Cmd, string) {
+func parseArchiveFormat(format string, c ArchiveCompression) (*exec.Cmd, string) {
 	switch format {
 	case "tar":
 		return nil, "tar"
 	case "tar.gz":
-		return exec.Command("gzip", "-c", "-n"), "tar"
+		return gzipCommand(c.Gzip), "tar"
 	case "tar.bz2":
-		return exec.Command("bzip2", "-c"), "tar"
+		return bzip2Command(c.Bzip2), "tar"
+	case "tar.xz":
+		return xzCommand(c.Xz), "tar"
+	case "tar.zst":
+		return zstdCommand(c.Zstd), "tar"
 	case "zip":
 		return nil, "zip"
 	}
 	return nil, "unknown"
 }
 
+// Tempfiles next to cached archives start with archiveTempPrefix, so that
+// they cannot be mistaken for archives
+const archiveTempPrefix = ".tmp-"
+
 func prepareArchiveTempfile(dir string, prefix string) (*os.File, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
-	return ioutil.TempFile(dir, prefix)
+	return ioutil.TempFile(dir, archiveTempPrefix+prefix)
+}
+
+func isArchiveTempfile(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), archiveTempPrefix)
 }
 
 func finalizeCachedArchive(tempFile *os.File, archivePath string) error {
@@ -192,6 +308,10 @@ func parseBasename(basename string) (string, bool) {
 		format = "tar.gz"
 	case "archive.tar.bz2", "archive.tbz", "archive.tbz2", "archive.tb2", "archive.bz2":
 		format = "tar.bz2"
+	case "archive.tar.xz", "archive.txz", "archive.xz":
+		format = "tar.xz"
+	case "archive.tar.zst", "archive.tzst", "archive.zst":
+		format = "tar.zst"
 	default:
 		return "", false
 	}
@@ -19,6 +19,12 @@ func TestParseBasename(t *testing.T) {
 		{".tbz2", "tar.bz2"},
 		{".tb2", "tar.bz2"},
 		{".bz2", "tar.bz2"},
+		{".tar.xz", "tar.xz"},
+		{".txz", "tar.xz"},
+		{".xz", "tar.xz"},
+		{".tar.zst", "tar.zst"},
+		{".tzst", "tar.zst"},
+		{".zst", "tar.zst"},
 	} {
 		basename := "archive" + testCase.in
 		out, ok := parseBasename(basename)
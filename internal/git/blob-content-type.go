@@ -0,0 +1,164 @@
+/*
+In this file we choose the content type of raw blobs, so that browsers do
+not run scripts from repositories on our domain
+*/
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// How to serve blobs of dangerous content types
+const (
+	BlobDangerousAsText       = "text"       // As text/plain
+	BlobDangerousAsAttachment = "attachment" // As a download
+)
+
+// BlobContentTypePolicy says how SendBlob serves blobs that browsers could
+// run as scripts
+type BlobContentTypePolicy struct {
+	DangerousTypes        []string // Media types, e.g. text/html
+	Dangerous             string   // BlobDangerousAsText or BlobDangerousAsAttachment
+	ContentSecurityPolicy string   // Of every blob; empty means none
+}
+
+// DefaultBlobContentTypePolicy serves markup and scripts as text, and
+// sandboxes everything else
+var DefaultBlobContentTypePolicy = BlobContentTypePolicy{
+	DangerousTypes: []string{
+		"text/html",
+		"application/xhtml+xml",
+		"image/svg+xml",
+		"text/xml",
+		"application/xml",
+		"text/xsl",
+		"text/javascript",
+		"application/javascript",
+		"application/x-javascript",
+		"application/ecmascript",
+		"text/ecmascript",
+		"application/x-shockwave-flash",
+	},
+	Dangerous:             BlobDangerousAsText,
+	ContentSecurityPolicy: "default-src 'none'; style-src 'unsafe-inline'; media-src 'self'; sandbox",
+}
+
+var blobContentTypePolicy = struct {
+	sync.RWMutex
+	BlobContentTypePolicy
+	dangerous map[string]bool
+}{
+	BlobContentTypePolicy: DefaultBlobContentTypePolicy,
+	dangerous:             mediaTypeSet(DefaultBlobContentTypePolicy.DangerousTypes),
+}
+
+// SetBlobContentTypePolicy sets the content type policy of SendBlob
+func SetBlobContentTypePolicy(p BlobContentTypePolicy) error {
+	if p.Dangerous != BlobDangerousAsText && p.Dangerous != BlobDangerousAsAttachment {
+		return fmt.Errorf("invalid way to serve dangerous blobs %q", p.Dangerous)
+	}
+	for _, t := range p.DangerousTypes {
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return fmt.Errorf("invalid media type %q: %v", t, err)
+		}
+	}
+
+	blobContentTypePolicy.Lock()
+	defer blobContentTypePolicy.Unlock()
+	blobContentTypePolicy.BlobContentTypePolicy = p
+	blobContentTypePolicy.dangerous = mediaTypeSet(p.DangerousTypes)
+	return nil
+}
+
+func mediaTypeSet(types []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, t := range types {
+		set[mediaType(t)] = true
+	}
+	return set
+}
+
+// mediaType returns the lower case media type of a Content-Type value
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// isDangerousMediaType reports whether a blob of media type t could run
+// scripts. Browsers render every XML type, e.g. application/rss+xml, like
+// they render SVG.
+func isDangerousMediaType(dangerousTypes map[string]bool, t string) bool {
+	return dangerousTypes[t] || strings.HasSuffix(t, "+xml")
+}
+
+// sniffBlobContentType works like http.DetectContentType, but also
+// recognizes SVG images without an XML declaration
+func sniffBlobContentType(head []byte) string {
+	trimmed := bytes.TrimLeft(head, "\t\n\x0c\r ")
+	if len(trimmed) >= 4 && bytes.EqualFold(trimmed[:4], []byte("<svg")) {
+		return "image/svg+xml"
+	}
+	return http.DetectContentType(head)
+}
+
+// blobFilename returns the file name in the Content-Disposition header that
+// GitLab set, or else the last element of the request path
+func blobFilename(header http.Header, r *http.Request) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	return path.Base(r.URL.Path)
+}
+
+// setBlobContentType sets the Content-Type and related headers of a blob
+// that starts with head. The content type is the one GitLab set, or else
+// the one of the file name, or else the one of the content. If any of these
+// is dangerous we serve the blob as text or as an attachment.
+func setBlobContentType(header http.Header, r *http.Request, head []byte) {
+	blobContentTypePolicy.RLock()
+	policy := blobContentTypePolicy.BlobContentTypePolicy
+	dangerousTypes := blobContentTypePolicy.dangerous
+	blobContentTypePolicy.RUnlock()
+
+	filename := blobFilename(header, r)
+	byName := mime.TypeByExtension(path.Ext(filename))
+	byContent := sniffBlobContentType(head)
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = byName
+	}
+	if contentType == "" {
+		contentType = byContent
+	}
+
+	dangerous := false
+	for _, t := range []string{contentType, byName, byContent} {
+		dangerous = dangerous || isDangerousMediaType(dangerousTypes, mediaType(t))
+	}
+	switch {
+	case dangerous && policy.Dangerous == BlobDangerousAsText:
+		contentType = "text/plain; charset=utf-8"
+	case dangerous && policy.Dangerous == BlobDangerousAsAttachment:
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		header.Set("Content-Disposition", disposition)
+	}
+
+	header.Set("Content-Type", contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	if policy.ContentSecurityPolicy != "" {
+		header.Set("Content-Security-Policy", policy.ContentSecurityPolicy)
+	}
+}
@@ -0,0 +1,89 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetBlobContentType(t *testing.T) {
+	defer SetBlobContentTypePolicy(DefaultBlobContentTypePolicy)
+
+	for _, tc := range []struct {
+		desc        string
+		path        string
+		railsType   string
+		head        string
+		dangerous   string
+		contentType string
+		disposition string
+	}{
+		{desc: "image by extension", path: "/raw/logo.png", head: "\x89PNG\r\n\x1a\n", contentType: "image/png"},
+		{desc: "type from GitLab", path: "/raw/file", railsType: "image/png", head: "\x89PNG\r\n\x1a\n", contentType: "image/png"},
+		{desc: "text by content", path: "/raw/README", head: "hello\n", contentType: "text/plain; charset=utf-8"},
+		{desc: "svg by extension", path: "/raw/logo.svg", head: "<svg></svg>", contentType: "text/plain; charset=utf-8"},
+		{desc: "svg by content", path: "/raw/logo", head: "  <svg onload=alert(1)>", contentType: "text/plain; charset=utf-8"},
+		{desc: "html by content with a safe type from GitLab", path: "/raw/page.txt", railsType: "text/plain", head: "<html><script>", contentType: "text/plain; charset=utf-8"},
+		{desc: "html from GitLab", path: "/raw/page", railsType: "text/html; charset=utf-8", head: "hi", contentType: "text/plain; charset=utf-8"},
+		{desc: "xml type not in the list", path: "/raw/feed", railsType: "application/rss+xml", head: "<rss>", contentType: "text/plain; charset=utf-8"},
+		{desc: "xml type with parameters", path: "/raw/doc", railsType: "Application/Vnd.Example+XML; charset=utf-8", head: "<doc>", contentType: "text/plain; charset=utf-8"},
+		{desc: "html as attachment", path: "/raw/page.html", head: "<html>", dangerous: BlobDangerousAsAttachment, contentType: "text/html; charset=utf-8", disposition: `attachment; filename=page.html`},
+		{desc: "safe type not as attachment", path: "/raw/logo.png", head: "\x89PNG\r\n\x1a\n", dangerous: BlobDangerousAsAttachment, contentType: "image/png"},
+	} {
+		policy := DefaultBlobContentTypePolicy
+		if tc.dangerous != "" {
+			policy.Dangerous = tc.dangerous
+		}
+		if err := SetBlobContentTypePolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+
+		header := make(http.Header)
+		if tc.railsType != "" {
+			header.Set("Content-Type", tc.railsType)
+		}
+		setBlobContentType(header, httptest.NewRequest("GET", tc.path, nil), []byte(tc.head))
+
+		if ct := header.Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", tc.desc, tc.contentType, ct)
+		}
+		if cd := header.Get("Content-Disposition"); cd != tc.disposition {
+			t.Errorf("%s: expected Content-Disposition %q, got %q", tc.desc, tc.disposition, cd)
+		}
+		if h := header.Get("X-Content-Type-Options"); h != "nosniff" {
+			t.Errorf("%s: expected nosniff, got %q", tc.desc, h)
+		}
+		if h := header.Get("Content-Security-Policy"); h != policy.ContentSecurityPolicy {
+			t.Errorf("%s: expected Content-Security-Policy %q, got %q", tc.desc, policy.ContentSecurityPolicy, h)
+		}
+	}
+}
+
+func TestSetBlobContentTypePolicy(t *testing.T) {
+	defer SetBlobContentTypePolicy(DefaultBlobContentTypePolicy)
+
+	policy := DefaultBlobContentTypePolicy
+	policy.Dangerous = "inline"
+	if err := SetBlobContentTypePolicy(policy); err == nil {
+		t.Error("expected an error for an invalid way to serve dangerous blobs")
+	}
+
+	policy = DefaultBlobContentTypePolicy
+	policy.DangerousTypes = []string{"text/"}
+	if err := SetBlobContentTypePolicy(policy); err == nil {
+		t.Error("expected an error for an invalid media type")
+	}
+
+	policy = BlobContentTypePolicy{Dangerous: BlobDangerousAsText}
+	if err := SetBlobContentTypePolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	header := make(http.Header)
+	setBlobContentType(header, httptest.NewRequest("GET", "/raw/page.html", nil), []byte("<html>"))
+	if ct := header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("expected html without dangerous types, got %q", ct)
+	}
+	if _, ok := header["Content-Security-Policy"]; ok {
+		t.Error("expected no Content-Security-Policy")
+	}
+}
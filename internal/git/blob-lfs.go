@@ -0,0 +1,90 @@
+/*
+In this file we serve the content of git lfs objects instead of their
+pointer files
+*/
+
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+)
+
+var errLfsObjectMissing = errors.New("lfs object missing")
+
+// openBlobLfsObject opens the object of the pointer file in data under
+// storagePath. It returns nil if data is not a pointer file, if the object
+// is not one of objects, or if the object is missing and missingPolicy says
+// to keep the pointer file.
+func openBlobLfsObject(data []byte, storagePath string, objects lfsObjectSet, missingPolicy string) (*lfsObjectReader, *lfs.Pointer, error) {
+	pointer, ok := lfs.ParsePointer(data)
+	if !ok || !objects[pointer.Oid] {
+		return nil, nil, nil
+	}
+
+	file, err := pointer.Open(storagePath)
+	if os.IsNotExist(err) {
+		if missingPolicy == lfsMissingPointer {
+			return nil, nil, nil
+		}
+		return nil, pointer, errLfsObjectMissing
+	}
+	if err != nil {
+		return nil, pointer, fmt.Errorf("lfs object %s: %v", pointer.Oid, err)
+	}
+
+	return &lfsObjectReader{file: file, pointer: pointer, hash: sha256.New()}, pointer, nil
+}
+
+// lfsObjectReader is an io.ReadSeeker of an lfs object. When it is read
+// from the start to the end it hashes the content, and it withholds the
+// last bytes unless the hash matches the pointer. Range requests of other
+// parts are not verified.
+type lfsObjectReader struct {
+	file    *os.File
+	pointer *lfs.Pointer
+	hash    hash.Hash
+	hashed  int64 // Bytes hashed since the last seek to the start
+	offset  int64
+}
+
+func (o *lfsObjectReader) Read(p []byte) (int, error) {
+	n, err := o.file.Read(p)
+	verify := o.hashed == o.offset
+	o.offset += int64(n)
+	if !verify {
+		return n, err
+	}
+
+	o.hash.Write(p[:n])
+	o.hashed += int64(n)
+	if o.hashed == o.pointer.Size {
+		if sum := hex.EncodeToString(o.hash.Sum(nil)); sum != o.pointer.Oid {
+			return 0, fmt.Errorf("lfs object %s: content has sha256 %s", o.pointer.Oid, sum)
+		}
+	}
+	return n, err
+}
+
+func (o *lfsObjectReader) Seek(offset int64, whence int) (int64, error) {
+	newOffset, err := o.file.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	if newOffset == 0 {
+		o.hash.Reset()
+		o.hashed = 0
+	}
+	o.offset = newOffset
+	return newOffset, nil
+}
+
+func (o *lfsObjectReader) Close() error {
+	return o.file.Close()
+}
@@ -0,0 +1,140 @@
+package git
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendBlobWithLfsObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob-lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "\x89PNG\r\n\x1a\n" + strings.Repeat("large file content\n", 100)
+	pointer, p := lfsPointerFile(content)
+	repoPath, blobId := setupBlobRepo(t, dir, []byte(pointer))
+	storage := filepath.Join(dir, "lfs-objects")
+	params := &blobParams{RepoPath: repoPath, BlobId: blobId, IncludeLfsBlobs: true, LfsStoragePath: storage, LfsOids: []string{p.Oid}}
+
+	r := httptest.NewRequest("GET", "/raw/large", nil)
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, r, blobSendData(t, params))
+	if w.Code != 404 {
+		t.Fatalf("expected 404 for a missing object, got %d", w.Code)
+	}
+
+	params.LfsMissing = lfsMissingPointer
+	r = httptest.NewRequest("GET", "/raw/large", nil)
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, blobSendData(t, params))
+	if w.Code != 200 || w.Body.String() != pointer {
+		t.Fatalf("expected the pointer file, got %d with %q", w.Code, w.Body.String())
+	}
+
+	objectPath := p.ObjectPath(storage)
+	os.MkdirAll(filepath.Dir(objectPath), 0755)
+	if err := ioutil.WriteFile(objectPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest("GET", "/raw/large", nil)
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	SendBlob.Inject(w, r, blobSendData(t, params))
+	if w.Code != 200 || w.Body.String() != content {
+		t.Fatalf("expected the object, got %d with %q", w.Code, w.Body.String())
+	}
+	if etag := w.Header().Get("ETag"); etag != `"sha256:`+p.Oid+`"` {
+		t.Fatalf("unexpected ETag %q", etag)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Fatalf("expected the content type of the object, got %q", ct)
+	}
+
+	// An object of another project
+	otherParams := *params
+	otherParams.LfsOids = []string{strings.Repeat("0", 64)}
+	r = httptest.NewRequest("GET", "/raw/large", nil)
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, blobSendData(t, &otherParams))
+	if w.Code != 200 || w.Body.String() != pointer {
+		t.Fatalf("expected the pointer file, got %d with %q", w.Code, w.Body.String())
+	}
+
+	otherParams.LfsOids = []string{"../../etc/passwd"}
+	r = httptest.NewRequest("GET", "/raw/large", nil)
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, blobSendData(t, &otherParams))
+	if w.Code != 500 {
+		t.Fatalf("expected 500 for an invalid oid, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/raw/large", nil)
+	r.Header.Set("Range", "bytes=1000-1009")
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, blobSendData(t, params))
+	if w.Code != 206 || w.Body.String() != content[1000:1010] {
+		t.Fatalf("expected 206 with %q, got %d with %q", content[1000:1010], w.Code, w.Body.String())
+	}
+}
+
+func TestLfsObjectReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob-lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("0123456789", 100)
+	pointerFile, p := lfsPointerFile(content)
+	objectPath := p.ObjectPath(dir)
+	os.MkdirAll(filepath.Dir(objectPath), 0755)
+	if err := ioutil.WriteFile(objectPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	object, _, err := openBlobLfsObject([]byte(pointerFile), dir, lfsObjectSet{p.Oid: true}, lfsMissingError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like http.ServeContent, which sniffs the content type first
+	if _, err := io.ReadFull(object, make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := object.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(object)
+	object.Close()
+	if err != nil || string(data) != content {
+		t.Fatalf("expected the object, got %d bytes, %v", len(data), err)
+	}
+
+	// Same size, other content
+	if err := ioutil.WriteFile(objectPath, []byte(strings.Repeat("9876543210", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	object, _, err = openBlobLfsObject([]byte(pointerFile), dir, lfsObjectSet{p.Oid: true}, lfsMissingError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	data, err = ioutil.ReadAll(io.LimitReader(object, p.Size))
+	if err == nil {
+		t.Fatal("expected a hash mismatch error")
+	}
+	if len(data) >= len(content) {
+		t.Fatal("expected the last bytes to be withheld")
+	}
+
+	if object, _, err := openBlobLfsObject([]byte("not a pointer\n"), dir, lfsObjectSet{p.Oid: true}, lfsMissingError); object != nil || err != nil {
+		t.Fatalf("expected no object, got %v, %v", object, err)
+	}
+}
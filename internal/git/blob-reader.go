@@ -0,0 +1,206 @@
+/*
+In this file we let http.ServeContent read blobs, which we can only stream
+from the start
+*/
+
+package git
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// http.ServeContent reads this many bytes to sniff the content type, and
+// then seeks back to the start
+const blobHeadSize = 512
+
+// We serve at most this many ranges of a blob in one response
+const maxBlobRanges = 10
+
+// seekableBlob is an io.ReadSeeker of a blob. Seeking forward skips data;
+// seeking backward opens the blob again, unless the data is in the first
+// blobHeadSize bytes, which we keep. http.ServeContent may read it from
+// another goroutine while we close it, e.g. for multi-range requests.
+type seekableBlob struct {
+	size int64
+	open func() (io.ReadCloser, error)
+
+	mu           sync.Mutex
+	offset       int64 // Of the next Read
+	stream       io.ReadCloser
+	streamOffset int64
+	head         []byte
+	err          error // The first read error other than io.EOF
+	closed       bool
+}
+
+var errBlobClosed = errors.New("seekableBlob: closed")
+
+// newSeekableBlob returns a reader of the blob of the given size. stream, if
+// not nil, reads the blob from the start; open starts reading it again.
+func newSeekableBlob(size int64, stream io.ReadCloser, open func() (io.ReadCloser, error)) *seekableBlob {
+	return &seekableBlob{size: size, stream: stream, open: open}
+}
+
+func (b *seekableBlob) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, errBlobClosed
+	}
+	if b.offset < int64(len(b.head)) {
+		n := copy(p, b.head[b.offset:])
+		b.offset += int64(n)
+		return n, nil
+	}
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+
+	if b.stream != nil && b.streamOffset > b.offset {
+		b.stream.Close()
+		b.stream = nil
+	}
+	if b.stream == nil {
+		stream, err := b.open()
+		if err != nil {
+			return 0, b.fail(err)
+		}
+		b.stream, b.streamOffset = stream, 0
+	}
+	if b.streamOffset < b.offset {
+		n, err := io.CopyN(ioutil.Discard, b.stream, b.offset-b.streamOffset)
+		b.streamOffset += n
+		if err != nil {
+			return 0, b.fail(err)
+		}
+	}
+
+	if remaining := b.size - b.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.stream.Read(p)
+	if b.streamOffset == int64(len(b.head)) && len(b.head) < blobHeadSize {
+		keep := n
+		if keep > blobHeadSize-len(b.head) {
+			keep = blobHeadSize - len(b.head)
+		}
+		b.head = append(b.head, p[:keep]...)
+	}
+	b.streamOffset += int64(n)
+	b.offset += int64(n)
+
+	if err == io.EOF && b.offset < b.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		b.fail(err)
+	}
+	return n, err
+}
+
+func (b *seekableBlob) fail(err error) error {
+	if b.err == nil {
+		b.err = err
+	}
+	return err
+}
+
+func (b *seekableBlob) Seek(offset int64, whence int) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("seekableBlob: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seekableBlob: negative position")
+	}
+
+	b.offset = offset
+	return offset, nil
+}
+
+// Close closes the open stream, and returns the first read error. Reads
+// fail after Close.
+func (b *seekableBlob) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	if b.stream != nil {
+		b.fail(b.stream.Close())
+		b.stream = nil
+	}
+	return b.err
+}
+
+// sequentialBlobRanges reports whether the ranges of the Range header value
+// can be served by reading a blob of the given size once: there are at
+// most maxBlobRanges and they are in ascending order without overlaps.
+// Invalid values are left to http.ServeContent.
+func sequentialBlobRanges(header string, size int64) bool {
+	if !strings.HasPrefix(header, "bytes=") {
+		return true
+	}
+
+	var count int
+	var end int64
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return true
+		}
+
+		var start int64
+		if i == 0 {
+			// The last n bytes
+			n, err := strconv.ParseInt(spec[1:], 10, 64)
+			if err != nil {
+				return true
+			}
+			if start = size - n; start < 0 {
+				start = 0
+			}
+		} else {
+			var err error
+			if start, err = strconv.ParseInt(spec[:i], 10, 64); err != nil {
+				return true
+			}
+		}
+		if start >= size {
+			continue // Not satisfiable, so not served
+		}
+
+		count++
+		if count > maxBlobRanges || start < end {
+			return false
+		}
+		end = size
+		if i > 0 && i < len(spec)-1 {
+			last, err := strconv.ParseInt(spec[i+1:], 10, 64)
+			if err != nil {
+				return true
+			}
+			if last+1 < size {
+				end = last + 1
+			}
+		}
+	}
+	return true
+}
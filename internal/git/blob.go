@@ -1,18 +1,34 @@
 package git
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 )
 
 type blob struct{ senddata.Prefix }
-type blobParams struct{ RepoPath, BlobId string }
+type blobParams struct {
+	RepoPath string
+	BlobId   string
+	GitEnv   map[string]string
+	// IncludeLfsBlobs serves the object in LfsStoragePath if the blob is an
+	// LFS pointer file of an object in LfsOids, the objects of the project.
+	// LfsMissing says what to do if the object is missing: "error" (the
+	// default) or "pointer".
+	IncludeLfsBlobs bool
+	LfsStoragePath  string
+	LfsOids         []string
+	LfsMissing      string
+}
 
 var SendBlob = &blob{"git-blob:"}
 
@@ -25,31 +41,164 @@ func (b *blob) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 
 	log.Printf("SendBlob: sending %q for %q", params.BlobId, r.URL.Path)
 
-	sizeOutput, err := gitCommand("", "git", "--git-dir="+params.RepoPath, "cat-file", "-s", params.BlobId).Output()
+	var lfsObjects lfsObjectSet
+	if params.IncludeLfsBlobs {
+		if params.LfsStoragePath == "" {
+			helper.Fail500(w, r, fmt.Errorf("SendBlob: LfsStoragePath empty"))
+			return
+		}
+		if params.LfsMissing == "" {
+			params.LfsMissing = lfsMissingError
+		}
+		if !validLfsMissingPolicy(params.LfsMissing) {
+			helper.Fail500(w, r, fmt.Errorf("SendBlob: invalid LfsMissing: %q", params.LfsMissing))
+			return
+		}
+		var err error
+		if lfsObjects, err = newLfsObjectSet(params.LfsOids); err != nil {
+			helper.Fail500(w, r, fmt.Errorf("SendBlob: %v", err))
+			return
+		}
+	}
+
+	env, err := gitEnv(params.GitEnv)
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendBlob: get blob size: %v", err))
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: %v", err))
+		return
+	}
+
+	// Blob IDs are immutable, so they make strong ETags
+	etag := params.BlobId
+	modtime, _ := http.ParseTime(w.Header().Get("Last-Modified"))
+
+	// The ETag of an LFS object is only known once we read the pointer file
+	if !params.IncludeLfsBlobs && serveBlobWithoutContent(w, r, etag, modtime) {
 		return
 	}
 
-	gitShowCmd := gitCommand("", "git", "--git-dir="+params.RepoPath, "cat-file", "blob", params.BlobId)
-	stdout, err := gitShowCmd.StdoutPipe()
+	object, err := catFileBatch.open(r.Context(), env, params.RepoPath, params.BlobId)
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendBlob: git cat-file stdout: %v", err))
+		helper.Fail500(w, r, helper.PrefixError("SendBlob: open blob", err))
+		return
+	}
+	if object.Type != "blob" {
+		object.Close()
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: %q is a %s", params.BlobId, object.Type))
 		return
 	}
-	if err := gitShowCmd.Start(); err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendBlob: start %v: %v", gitShowCmd, err))
+	size := object.Size
+
+	blob := newSeekableBlob(size, object, func() (io.ReadCloser, error) {
+		// Seeking backward needs the blob again
+		return catFileBatch.open(r.Context(), env, params.RepoPath, params.BlobId)
+	})
+	defer func() {
+		if err := blob.Close(); err != nil {
+			helper.LogError(r, err)
+		}
+	}()
+	var content io.ReadSeeker = blob
+
+	if params.IncludeLfsBlobs && size < lfs.MaxPointerSize {
+		data, err := ioutil.ReadAll(blob)
+		if err != nil {
+			helper.Fail500(w, r, helper.PrefixError("SendBlob: read blob", err))
+			return
+		}
+		content = bytes.NewReader(data)
+
+		object, pointer, err := openBlobLfsObject(data, params.LfsStoragePath, lfsObjects, params.LfsMissing)
+		if err == errLfsObjectMissing {
+			http.Error(w, fmt.Sprintf("LFS object %s not found", pointer.Oid), 404)
+			return
+		}
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("SendBlob: %v", err))
+			return
+		}
+		if object != nil {
+			defer object.Close()
+			log.Printf("SendBlob: sending LFS object %s of %q", pointer.Oid, params.BlobId)
+			content, size, etag = object, pointer.Size, "sha256:"+pointer.Oid
+			// GitLab set the content type of the pointer file
+			w.Header().Del("Content-Type")
+		}
+	}
+
+	if serveBlobWithoutContent(w, r, etag, modtime) {
 		return
 	}
-	defer helper.CleanUpProcessGroup(gitShowCmd)
 
-	w.Header().Set("Content-Length", strings.TrimSpace(string(sizeOutput)))
-	if _, err := io.Copy(w, stdout); err != nil {
-		helper.LogError(r, &copyError{fmt.Errorf("SendBlob: copy git cat-file stdout: %v", err)})
+	// HEAD requests get the Content-Type of GET requests, so we sniff them
+	// too; http.ServeContent sends no body for them
+
+	headSize := size
+	if headSize > blobHeadSize {
+		headSize = blobHeadSize
+	}
+	head := make([]byte, headSize)
+	if _, err := io.ReadFull(content, head); err != nil {
+		helper.Fail500(w, r, helper.PrefixError("SendBlob: read blob", err))
 		return
 	}
-	if err := gitShowCmd.Wait(); err != nil {
-		helper.LogError(r, fmt.Errorf("SendBlob: wait for git cat-file: %v", err))
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: %v", err))
 		return
 	}
+	setBlobContentType(w.Header(), r, head)
+
+	if content == io.ReadSeeker(blob) && !sequentialBlobRanges(r.Header.Get("Range"), size) {
+		// Each range before the previous one would read the blob again, so
+		// we send all of it
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, "", modtime, content)
+}
+
+// serveBlobWithoutContent sets the ETag of a blob, and answers the request
+// with a 304 if it has a matching If-None-Match or If-Modified-Since.
+// Requests with If-Match or If-Unmodified-Since are left to
+// http.ServeContent.
+func serveBlobWithoutContent(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) bool {
+	w.Header().Set("ETag", `"`+etag+`"`)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-Unmodified-Since") != "" {
+		return false
+	}
+
+	if blobNotModified(r, etag, modtime) {
+		h := w.Header()
+		delete(h, "Content-Type")
+		delete(h, "Content-Length")
+		delete(h, "Last-Modified")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// blobNotModified evaluates If-None-Match, or else If-Modified-Since, like
+// http.ServeContent does
+func blobNotModified(r *http.Request, etag string, modtime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			// The weak comparison
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == `"`+etag+`"` {
+				return true
+			}
+		}
+		return false
+	}
+
+	if modtime.IsZero() || modtime.Equal(time.Unix(0, 0)) {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(since)
 }
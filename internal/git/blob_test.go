@@ -0,0 +1,341 @@
+package git
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupBlobRepo(t *testing.T, dir string, content []byte) (repoPath string, blobId string) {
+	repo := filepath.Join(dir, "repo")
+	runGit(t, dir, nil, "init", "-q", repo)
+	blobId = strings.TrimSpace(string(runGit(t, repo, content, "hash-object", "-w", "--stdin")))
+	return filepath.Join(repo, ".git"), blobId
+}
+
+func blobSendData(t *testing.T, params *blobParams) string {
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "git-blob:" + base64.URLEncoding.EncodeToString(data)
+}
+
+func testBlobContent() []byte {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	return content
+}
+
+func TestSendBlobRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := testBlobContent()
+	repoPath, blobId := setupBlobRepo(t, dir, content)
+	sendData := blobSendData(t, &blobParams{RepoPath: repoPath, BlobId: blobId})
+
+	r := httptest.NewRequest("GET", "/blob", nil)
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("expected the whole blob, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if etag := w.Header().Get("ETag"); etag != `"`+blobId+`"` {
+		t.Fatalf("unexpected ETag %q", etag)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected Content-Type %q", ct)
+	}
+
+	r = httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("Range", "bytes=60000-60009")
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 206 || w.Body.String() != string(content[60000:60010]) {
+		t.Fatalf("expected 206 with %q, got %d with %q", content[60000:60010], w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("Range", "bytes=10-14,70000-70004")
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 206 {
+		t.Fatalf("expected 206, got %d", w.Code)
+	}
+	_, mediaParams, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(w.Body, mediaParams["boundary"])
+	for _, expected := range [][]byte{content[10:15], content[70000:70005]} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("expected part %q, got %q", expected, data)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("expected two parts, got %v", err)
+	}
+
+	// Out of order ranges would read the blob again
+	r = httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("Range", "bytes=70000-70004,10-14")
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("expected the whole blob, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	r = httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("If-None-Match", `"`+blobId+`"`)
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 304 || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 304, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestSendBlobWithoutContent(t *testing.T) {
+	// Reading this blob would fail
+	blobId := strings.Repeat("1", 40)
+	sendData := blobSendData(t, &blobParams{RepoPath: "/nonexistent", BlobId: blobId})
+
+	r := httptest.NewRequest("GET", "/raw/page.html", nil)
+	r.Header.Set("If-None-Match", `"other", W/"`+blobId+`"`)
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 304 || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 304, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	r = httptest.NewRequest("GET", "/raw/page.html", nil)
+	r.Header.Set("If-Modified-Since", "Tue, 01 Jan 2019 00:00:00 GMT")
+	w = httptest.NewRecorder()
+	w.Header().Set("Last-Modified", "Mon, 31 Dec 2018 00:00:00 GMT")
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 304 {
+		t.Fatalf("expected 304, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/raw/page.html", nil)
+	r.Header.Set("If-None-Match", `"other"`)
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 500 {
+		t.Fatalf("expected a failure to read the blob, got %d", w.Code)
+	}
+}
+
+func TestSendBlobHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := append([]byte("\x89PNG\x0d\x0a\x1a\x0a"), testBlobContent()...)
+	repoPath, blobId := setupBlobRepo(t, dir, content)
+	sendData := blobSendData(t, &blobParams{RepoPath: repoPath, BlobId: blobId})
+
+	r := httptest.NewRequest("GET", "/raw/image", nil)
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("expected the whole blob, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	getType := w.Header().Get("Content-Type")
+	if getType != "image/png" {
+		t.Fatalf("unexpected Content-Type %q", getType)
+	}
+
+	r = httptest.NewRequest("HEAD", "/raw/image", nil)
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	if w.Code != 200 || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 200, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != getType {
+		t.Fatalf("expected Content-Type %q like GET, got %q", getType, ct)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != fmt.Sprint(len(content)) {
+		t.Fatalf("expected Content-Length %d, got %q", len(content), cl)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"`+blobId+`"` {
+		t.Fatalf("unexpected ETag %q", etag)
+	}
+}
+
+type countingOpener struct {
+	content []byte
+	opens   int
+}
+
+func (c *countingOpener) open() (io.ReadCloser, error) {
+	c.opens++
+	return ioutil.NopCloser(bytes.NewReader(c.content)), nil
+}
+
+func TestSeekableBlob(t *testing.T) {
+	opener := &countingOpener{content: testBlobContent()}
+	blob := newSeekableBlob(int64(len(opener.content)), nil, opener.open)
+	defer blob.Close()
+
+	read := func(offset int64, n int) {
+		if _, err := blob.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(blob, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, opener.content[offset:offset+int64(n)]) {
+			t.Fatalf("unexpected content at %d", offset)
+		}
+	}
+
+	if opener.opens != 0 {
+		t.Fatal("expected no stream before the first read")
+	}
+	read(0, blobHeadSize)
+	read(0, 100)   // From the head
+	read(1000, 10) // Skipping forward
+	if opener.opens != 1 {
+		t.Fatalf("expected 1 open, got %d", opener.opens)
+	}
+	read(600, 10) // Seeking backward past the head
+	if opener.opens != 2 {
+		t.Fatalf("expected 2 opens, got %d", opener.opens)
+	}
+
+	if _, err := blob.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := blob.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("expected EOF at the end, got %d, %v", n, err)
+	}
+}
+
+func TestSeekableBlobShortStream(t *testing.T) {
+	opener := &countingOpener{content: []byte("short")}
+	blob := newSeekableBlob(10, nil, opener.open)
+
+	if _, err := ioutil.ReadAll(blob); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if err := blob.Close(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected Close to return %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestSeekableBlobInitialStream(t *testing.T) {
+	opener := &countingOpener{content: testBlobContent()}
+	stream := ioutil.NopCloser(bytes.NewReader(opener.content))
+	blob := newSeekableBlob(int64(len(opener.content)), stream, opener.open)
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, opener.content) {
+		t.Fatal("unexpected content")
+	}
+	if opener.opens != 0 {
+		t.Fatalf("expected no opens, got %d", opener.opens)
+	}
+}
+
+func TestSeekableBlobOpenError(t *testing.T) {
+	openErr := errors.New("open failed")
+	blob := newSeekableBlob(10, nil, func() (io.ReadCloser, error) { return nil, openErr })
+
+	if _, err := blob.Read(make([]byte, 10)); err != openErr {
+		t.Fatalf("expected %v, got %v", openErr, err)
+	}
+	if err := blob.Close(); err != openErr {
+		t.Fatalf("expected Close to return %v, got %v", openErr, err)
+	}
+}
+
+func TestSeekableBlobReadAfterClose(t *testing.T) {
+	opener := &countingOpener{content: testBlobContent()}
+	blob := newSeekableBlob(int64(len(opener.content)), nil, opener.open)
+	if err := blob.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := blob.Read(make([]byte, 10)); err != errBlobClosed {
+		t.Fatalf("expected %v, got %v", errBlobClosed, err)
+	}
+	if opener.opens != 0 {
+		t.Fatalf("expected no opens after Close, got %d", opener.opens)
+	}
+}
+
+func TestSeekableBlobConcurrentClose(t *testing.T) {
+	opener := &countingOpener{content: testBlobContent()}
+	blob := newSeekableBlob(int64(len(opener.content)), nil, opener.open)
+
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, blob)
+		done <- err
+	}()
+	blob.Close()
+
+	if err := <-done; err != nil && err != errBlobClosed {
+		t.Fatalf("expected the whole blob or %v, got %v", errBlobClosed, err)
+	}
+}
+
+func TestSequentialBlobRanges(t *testing.T) {
+	tooMany := make([]string, maxBlobRanges+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%d-%d", i*10, i*10+4)
+	}
+
+	for _, tc := range []struct {
+		header   string
+		expected bool
+	}{
+		{"", true},
+		{"bytes=0-9", true},
+		{"bytes=0-9,10-19,-10", true},
+		{"bytes=0-9, 2000-3000, 50-60", true}, // 2000-3000 is not satisfiable
+		{"bytes=10-19,0-9", false},
+		{"bytes=0-19,10-29", false},
+		{"bytes=-10,0-9", false},
+		{"bytes=50-,0-9", false},
+		{"bytes=" + strings.Join(tooMany[:maxBlobRanges], ","), true},
+		{"bytes=" + strings.Join(tooMany, ","), false},
+		{"bytes=x-y,0-9", true}, // Invalid, left to http.ServeContent
+	} {
+		if actual := sequentialBlobRanges(tc.header, 1000); actual != tc.expected {
+			t.Errorf("%q: expected %v, got %v", tc.header, tc.expected, actual)
+		}
+	}
+}
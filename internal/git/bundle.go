@@ -0,0 +1,290 @@
+/*
+In this file we handle downloads of pre-generated 'git bundle' files, which
+clients can clone from before they fetch the rest with upload-pack
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+)
+
+type bundle struct{ senddata.Prefix }
+type bundleCreation struct{ senddata.Prefix }
+type bundleParams struct {
+	RepoPath   string
+	BundlePath string
+	GitEnv     map[string]string
+}
+
+// SendBundle serves the bundle at BundlePath. It does not create missing
+// bundles; that is up to GitLab, with CreateBundle.
+var SendBundle = &bundle{"git-bundle:"}
+
+// CreateBundle (re)creates the bundle at BundlePath in the background if
+// it is missing or if the refs of the repository have changed since it
+// was created. GitLab sends it e.g. after a push.
+var CreateBundle = &bundleCreation{"git-bundle-create:"}
+
+// The longest bundle header line we accept, a ref with its object ID
+const maxBundleHeaderLine = 64 * 1024
+
+func (b *bundle) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params bundleParams
+	if err := b.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: unpack sendData: %v", err))
+		return
+	}
+
+	// Bundles under the archive cache root are evicted like archives
+	cachedBundle, release, err := archiveCache.open(params.BundlePath)
+	if os.IsNotExist(err) {
+		// We only serve complete bundles, so that every client can resume
+		// its download with a Range request. Clients that get no bundle
+		// clone with upload-pack instead.
+		http.Error(w, "Bundle not found", 404)
+		return
+	}
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: open bundle: %v", err))
+		return
+	}
+	defer release()
+	defer cachedBundle.Close()
+
+	fi, err := cachedBundle.Stat()
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: stat bundle: %v", err))
+		return
+	}
+
+	log.Printf("SendBundle: serving %q for %q", params.BundlePath, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, path.Base(params.BundlePath)))
+	w.Header().Set("Cache-Control", "private")
+	// Lets clients resume with If-Range only while the bundle is unchanged
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+	http.ServeContent(w, r, "", fi.ModTime(), cachedBundle)
+}
+
+func (b *bundleCreation) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params bundleParams
+	if err := b.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("CreateBundle: unpack sendData: %v", err))
+		return
+	}
+
+	startBundleGeneration(params)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// The bundles that are being generated, by bundle path
+var bundleGenerations = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// startBundleGeneration creates the bundle for params in the background if
+// it is missing or stale, unless that is already happening. The generation
+// does not depend on the request that started it.
+func startBundleGeneration(params bundleParams) {
+	bundleGenerations.Lock()
+	defer bundleGenerations.Unlock()
+	if bundleGenerations.m[params.BundlePath] {
+		return
+	}
+	bundleGenerations.m[params.BundlePath] = true
+
+	go func() {
+		defer func() {
+			bundleGenerations.Lock()
+			delete(bundleGenerations.m, params.BundlePath)
+			bundleGenerations.Unlock()
+		}()
+
+		ctx := context.Background()
+		stale, err := bundleIsStale(ctx, params)
+		if err != nil {
+			helper.LogError(nil, helper.PrefixError("CreateBundle", err))
+			return
+		}
+		if !stale {
+			return
+		}
+
+		log.Printf("CreateBundle: creating %q", params.BundlePath)
+		if err := createBundle(ctx, params); err != nil {
+			helper.LogError(nil, helper.PrefixError("CreateBundle", err))
+		}
+	}()
+}
+
+// bundleIsStale tells whether the bundle for params is missing, or has
+// other refs than HEAD, the branches and the tags of the repository now
+func bundleIsStale(ctx context.Context, params bundleParams) (bool, error) {
+	bundleRefs, err := readBundleRefs(params.BundlePath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	repoRefs, err := readBundledRepoRefs(ctx, params)
+	if err != nil {
+		return false, err
+	}
+
+	if len(bundleRefs) != len(repoRefs) {
+		return true, nil
+	}
+	for i := range bundleRefs {
+		if bundleRefs[i] != repoRefs[i] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readBundleRefs returns the sorted "<object ID> <ref>" lines in the header
+// of the bundle at bundlePath
+func readBundleRefs(bundlePath string) ([]string, error) {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, maxBundleHeaderLine)
+	var refs []string
+	for first := true; ; first = false {
+		line, err := readBundleHeaderLine(reader)
+		if err != nil {
+			return nil, fmt.Errorf("read header of %q: %v", bundlePath, err)
+		}
+
+		switch {
+		case first:
+			if line != "# v2 git bundle" && line != "# v3 git bundle" {
+				return nil, fmt.Errorf("%q is not a bundle", bundlePath)
+			}
+		case line == "":
+			// The header ends with an empty line
+			sort.Strings(refs)
+			return refs, nil
+		case strings.HasPrefix(line, "@"), strings.HasPrefix(line, "-"):
+			// Capabilities and prerequisites
+		default:
+			refs = append(refs, line)
+		}
+	}
+}
+
+func readBundleHeaderLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("header line too long")
+	}
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(line, []byte("\n"))), nil
+}
+
+// readBundledRepoRefs returns the sorted "<object ID> <ref>" lines of the
+// refs of the repository that createBundle puts in the bundle
+func readBundledRepoRefs(ctx context.Context, params bundleParams) ([]string, error) {
+	env, err := gitEnv(params.GitEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := gitCommand("", env, "git", "--git-dir="+params.RepoPath, "show-ref", "--head")
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	helper.LimitProcess("bundle", cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %v: %v", cmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(ctx, "bundle", cmd)()
+
+	if err := cmd.Wait(); err != nil {
+		// Exit status 1 means there are no refs
+		if status, ok := helper.ExitStatus(err); !ok || status != 1 {
+			return nil, helper.NewProcessError(cmd, fmt.Errorf("wait for %v: %v", cmd.Args, err))
+		}
+	}
+
+	var refs []string
+	for _, line := range strings.Split(output.String(), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if ref := fields[1]; ref == "HEAD" || strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "refs/tags/") {
+			refs = append(refs, line)
+		}
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// createBundle writes a bundle of the branches and tags of the repository
+// to a tempfile and then moves it into place. Unlike archives, bundles are
+// replaced when they are stale, so we rename instead of link. Clients that
+// are downloading the old bundle keep reading it, and resuming clients see
+// that the ETag changed.
+func createBundle(ctx context.Context, params bundleParams) error {
+	env, err := gitEnv(params.GitEnv)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := prepareArchiveTempfile(path.Dir(params.BundlePath), path.Base(params.BundlePath))
+	if err != nil {
+		return fmt.Errorf("create tempfile: %v", err)
+	}
+	defer tempFile.Close()
+	defer os.Remove(tempFile.Name())
+
+	bundleCmd := gitCommand("", env, "git", "--git-dir="+params.RepoPath, "bundle", "create", "-", "HEAD", "--branches", "--tags")
+	bundleCmd.Stdout = tempFile
+	helper.LimitProcess("bundle", bundleCmd)
+	if err := bundleCmd.Start(); err != nil {
+		return fmt.Errorf("start %v: %v", bundleCmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(bundleCmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(ctx, "bundle", bundleCmd)()
+
+	if err := bundleCmd.Wait(); err != nil {
+		return helper.NewProcessError(bundleCmd, fmt.Errorf("wait for %v: %v", bundleCmd.Args, err))
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("finalize bundle: %v", err)
+	}
+	if err := os.Rename(tempFile.Name(), params.BundlePath); err != nil {
+		return fmt.Errorf("finalize bundle: %v", err)
+	}
+	archiveCache.add(params.BundlePath)
+	return nil
+}
@@ -0,0 +1,130 @@
+package git
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	runGit(t, dir, nil, "init", "-q", repo)
+	runGit(t, repo, nil, "commit", "-q", "--allow-empty", "-m", "initial")
+
+	params := &bundleParams{RepoPath: filepath.Join(repo, ".git"), BundlePath: filepath.Join(dir, "cache", "clone.bundle")}
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.URLEncoding.EncodeToString(data)
+
+	// Clients do not trigger the generation of missing bundles
+	r := httptest.NewRequest("GET", "/group/project.git/clone.bundle", nil)
+	w := httptest.NewRecorder()
+	SendBundle.Inject(w, r, "git-bundle:"+encoded)
+	if w.Code != 404 {
+		t.Fatalf("expected 404, got %d: %s", w.Code, w.Body.String())
+	}
+
+	createBundleAndWait(t, "git-bundle-create:"+encoded, params.BundlePath, time.Time{})
+
+	r = httptest.NewRequest("GET", "/group/project.git/clone.bundle", nil)
+	w = httptest.NewRecorder()
+	SendBundle.Inject(w, r, "git-bundle:"+encoded)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "# v2 git bundle\n") {
+		t.Fatalf("expected a bundle, got %q", body)
+	}
+
+	// The second request resumes the download from the cached bundle
+	r = httptest.NewRequest("GET", "/group/project.git/clone.bundle", nil)
+	r.Header.Set("Range", "bytes=5-")
+	w = httptest.NewRecorder()
+	SendBundle.Inject(w, r, "git-bundle:"+encoded)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", w.Code)
+	}
+	if w.Body.String() != body[5:] {
+		t.Fatalf("expected the rest of the bundle, got %q", w.Body.String())
+	}
+}
+
+func TestCreateBundleRefreshesStaleBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	runGit(t, dir, nil, "init", "-q", repo)
+	runGit(t, repo, nil, "commit", "-q", "--allow-empty", "-m", "initial")
+	runGit(t, repo, nil, "tag", "-a", "-m", "v1", "v1")
+
+	params := &bundleParams{RepoPath: filepath.Join(repo, ".git"), BundlePath: filepath.Join(dir, "clone.bundle")}
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendData := "git-bundle-create:" + base64.URLEncoding.EncodeToString(data)
+
+	first := createBundleAndWait(t, sendData, params.BundlePath, time.Time{})
+	if stale, err := bundleIsStale(context.Background(), *params); err != nil || stale {
+		t.Fatalf("expected a fresh bundle, got stale=%v, %v", stale, err)
+	}
+
+	runGit(t, repo, nil, "commit", "-q", "--allow-empty", "-m", "second")
+	if stale, err := bundleIsStale(context.Background(), *params); err != nil || !stale {
+		t.Fatalf("expected a stale bundle after a new commit, got stale=%v, %v", stale, err)
+	}
+
+	createBundleAndWait(t, sendData, params.BundlePath, first)
+	head := strings.TrimSpace(string(runGit(t, repo, nil, "rev-parse", "HEAD")))
+	refs, err := readBundleRefs(params.BundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(refs, "\n"), head+" HEAD") {
+		t.Fatalf("expected the refreshed bundle to have HEAD at %s, got %v", head, refs)
+	}
+}
+
+// createBundleAndWait sends CreateBundle and waits until the generation is
+// done and the bundle at bundlePath is newer than modTime
+func createBundleAndWait(t *testing.T, sendData string, bundlePath string, modTime time.Time) time.Time {
+	r := httptest.NewRequest("POST", "/api/v4/projects/1/repository/bundle", nil)
+	w := httptest.NewRecorder()
+	CreateBundle.Inject(w, r, sendData)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		bundleGenerations.Lock()
+		running := bundleGenerations.m[bundlePath]
+		bundleGenerations.Unlock()
+		if fi, err := os.Stat(bundlePath); err == nil && fi.ModTime().After(modTime) && !running {
+			return fi.ModTime()
+		}
+	}
+	t.Fatalf("bundle %q was not created", bundlePath)
+	return time.Time{}
+}
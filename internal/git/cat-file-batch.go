@@ -0,0 +1,612 @@
+/*
+In this file we keep 'git cat-file --batch' processes running between
+requests, so that reading an object does not cost a new process
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+var (
+	catFileBatchStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gitlab_workhorse_cat_file_batch_started",
+		Help: "How many 'git cat-file --batch' processes have been started.",
+	})
+
+	catFileBatchRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_cat_file_batch_requests",
+			Help: "How many objects have been read with 'git cat-file --batch', partitioned by whether an idle process was reused (reused, new).",
+		},
+		[]string{"process"},
+	)
+
+	catFileBatchIdle = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_cat_file_batch_idle",
+		Help: "Number of idle 'git cat-file --batch' processes.",
+	})
+
+	catFileBatchProcesses = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_cat_file_batch_processes",
+		Help: "Number of running 'git cat-file --batch' processes, busy or idle.",
+	})
+
+	catFileBatchWaits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gitlab_workhorse_cat_file_batch_waits",
+		Help: "How many times a request waited because there were too many 'git cat-file --batch' processes.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(catFileBatchStarted)
+	prometheus.MustRegister(catFileBatchRequests)
+	prometheus.MustRegister(catFileBatchIdle)
+	prometheus.MustRegister(catFileBatchProcesses)
+	prometheus.MustRegister(catFileBatchWaits)
+}
+
+// CatFileBatchConfig limits the 'git cat-file --batch' processes. Requests
+// that need a process beyond MaxProcesses or MaxPerRepository wait for one.
+type CatFileBatchConfig struct {
+	MaxIdle          int           // Across all repositories; 0 keeps none
+	IdleTimeout      time.Duration // 0 means no limit
+	MaxProcesses     int           // Busy or idle; 0 means no limit
+	MaxPerRepository int           // Busy or idle; 0 means no limit
+}
+
+// DefaultCatFileBatchConfig keeps processes for a minute
+var DefaultCatFileBatchConfig = CatFileBatchConfig{MaxIdle: 50, IdleTimeout: time.Minute, MaxProcesses: 100, MaxPerRepository: 10}
+
+var catFileBatch = newCatFileBatchPool(DefaultCatFileBatchConfig)
+
+var errObjectMissing = errors.New("object missing")
+
+// Bigger objects are copied out of 'git cat-file --batch' into a tempfile
+const maxCatFileObjectInMemory = 1 << 20
+
+// ConfigureCatFileBatch sets the limits of the idle 'git cat-file --batch'
+// processes
+func ConfigureCatFileBatch(cfg CatFileBatchConfig) error {
+	if cfg.MaxIdle < 0 {
+		return fmt.Errorf("invalid maximum number of idle processes %d", cfg.MaxIdle)
+	}
+	if cfg.IdleTimeout < 0 {
+		return fmt.Errorf("invalid idle timeout %v", cfg.IdleTimeout)
+	}
+	if cfg.MaxProcesses < 0 {
+		return fmt.Errorf("invalid maximum number of processes %d", cfg.MaxProcesses)
+	}
+	if cfg.MaxPerRepository < 0 {
+		return fmt.Errorf("invalid maximum number of processes per repository %d", cfg.MaxPerRepository)
+	}
+
+	catFileBatch.configure(cfg)
+	return nil
+}
+
+// catFileBatchPool holds the idle processes, and counts the running ones.
+// Processes that are reading an object for a request are not in the pool.
+type catFileBatchPool struct {
+	sync.Mutex
+	CatFileBatchConfig
+	idle    *list.List     // Of *catFileBatchProcess, most recently used at the front
+	running map[string]int // By repository, including starting and stopping processes
+	total   int
+	changed chan struct{} // Closed when a process becomes idle or stops
+}
+
+type catFileBatchProcess struct {
+	key       string // Processes can only be shared if they have the same key
+	repoPath  string
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    *bufio.Reader
+	stopWatch func()
+	idleTimer *time.Timer
+}
+
+func newCatFileBatchPool(cfg CatFileBatchConfig) *catFileBatchPool {
+	return &catFileBatchPool{
+		CatFileBatchConfig: cfg,
+		idle:               list.New(),
+		running:            make(map[string]int),
+		changed:            make(chan struct{}),
+	}
+}
+
+func (c *catFileBatchPool) configure(cfg CatFileBatchConfig) {
+	c.Lock()
+	defer c.Unlock()
+	c.CatFileBatchConfig = cfg
+	c.evict()
+	c.broadcast() // The limits may have gone up
+}
+
+// broadcast wakes up the requests that wait for a process. The caller must
+// hold the lock.
+func (c *catFileBatchPool) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// open starts reading object from the repository at repoPath. It returns
+// errObjectMissing if there is no such object. The caller must close the
+// returned object.
+func (c *catFileBatchPool) open(ctx context.Context, env []string, repoPath string, object string) (*catFileObject, error) {
+	if object == "" || strings.ContainsAny(object, "\x00\n") {
+		return nil, fmt.Errorf("invalid object name %q", object)
+	}
+	key := repoPath + "\x00" + strings.Join(env, "\x00")
+
+	for retried := false; ; retried = true {
+		p, err := c.acquire(ctx, key, repoPath)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			if p, err = startCatFileBatch(key, env, repoPath); err != nil {
+				c.release(repoPath)
+				return nil, err
+			}
+			catFileBatchRequests.WithLabelValues("new").Inc()
+			return c.request(ctx, p, object)
+		}
+
+		catFileBatchRequests.WithLabelValues("reused").Inc()
+		o, err := c.request(ctx, p, object)
+		if err == nil || err == errObjectMissing || ctx.Err() != nil || retried {
+			return o, err
+		}
+		// The process may have died while it was idle. We try once more.
+	}
+}
+
+// acquire takes an idle process with key from the pool. If there is none,
+// it returns nil and counts a new process for repoPath, which the caller
+// must start or release. If the limits do not allow a new process, it
+// stops an idle one that is in the way, or waits for a process to become
+// idle or stop.
+func (c *catFileBatchPool) acquire(ctx context.Context, key string, repoPath string) (*catFileBatchProcess, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	waited := false
+	for {
+		if p := c.take(key); p != nil {
+			return p, nil
+		}
+
+		repoFull := c.MaxPerRepository > 0 && c.running[repoPath] >= c.MaxPerRepository
+		totalFull := c.MaxProcesses > 0 && c.total >= c.MaxProcesses
+		if !repoFull && !totalFull {
+			c.running[repoPath]++
+			c.total++
+			catFileBatchProcesses.Set(float64(c.total))
+			return nil, nil
+		}
+
+		if elem := c.idleInTheWay(repoPath, repoFull); elem != nil {
+			// The process only counts until it has stopped
+			c.remove(elem)
+		}
+
+		if !waited {
+			catFileBatchWaits.Inc()
+			waited = true
+		}
+		changed := c.changed
+		c.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		c.Lock()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// idleInTheWay returns the least recently used idle process of repoPath,
+// or of any repository if repoFull is false. The caller must hold the
+// lock.
+func (c *catFileBatchPool) idleInTheWay(repoPath string, repoFull bool) *list.Element {
+	for elem := c.idle.Back(); elem != nil; elem = elem.Prev() {
+		if !repoFull || elem.Value.(*catFileBatchProcess).repoPath == repoPath {
+			return elem
+		}
+	}
+	return nil
+}
+
+// release stops counting a process of repoPath
+func (c *catFileBatchPool) release(repoPath string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.running[repoPath]--; c.running[repoPath] <= 0 {
+		delete(c.running, repoPath)
+	}
+	c.total--
+	catFileBatchProcesses.Set(float64(c.total))
+	c.broadcast()
+}
+
+// stop ends p, and then stops counting it
+func (c *catFileBatchPool) stop(p *catFileBatchProcess) {
+	p.stop()
+	c.release(p.repoPath)
+}
+
+func startCatFileBatch(key string, env []string, repoPath string) (*catFileBatchProcess, error) {
+	cmd := gitCommand("", env, "git", "--git-dir="+repoPath, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file --batch stdin: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file --batch stdout: %v", err)
+	}
+	helper.LimitProcess("cat-file-batch", cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %v: %v", cmd.Args, err)
+	}
+	catFileBatchStarted.Inc()
+
+	return &catFileBatchProcess{
+		key:      key,
+		repoPath: repoPath,
+		cmd:      cmd,
+		stdin:    stdin,
+		stdout:   bufio.NewReader(stdout),
+		// The process outlives the request that started it, so only its
+		// limits apply, not the request context
+		stopWatch: helper.WatchProcessGroup(context.Background(), "cat-file-batch", cmd),
+	}, nil
+}
+
+// request asks p for object, and reads the header of the answer. If it
+// fails, p is stopped.
+func (c *catFileBatchPool) request(ctx context.Context, p *catFileBatchProcess, object string) (*catFileObject, error) {
+	// Stop the process if the request goes away, or the object is closed,
+	// while the process is busy
+	ctx, cancel := context.WithCancel(ctx)
+	stopCancel := afterFunc(ctx, p.kill)
+
+	fail := func(err error) (*catFileObject, error) {
+		stopCancel()
+		cancel()
+		c.stop(p)
+		return nil, helper.NewProcessError(p.cmd, fmt.Errorf("git cat-file --batch: %v", err))
+	}
+
+	if stderr, ok := p.cmd.Stderr.(*helper.StderrBuffer); ok {
+		// Only log what the process says while it serves this request
+		stderr.Reset()
+	}
+
+	if _, err := io.WriteString(p.stdin, object+"\n"); err != nil {
+		return fail(err)
+	}
+	header, err := p.stdout.ReadString('\n')
+	if err != nil {
+		return fail(err)
+	}
+	header = strings.TrimSuffix(header, "\n")
+
+	// The answer is "<oid> <type> <size>" and the content, or "<object>
+	// missing"
+	if header == object+" missing" || header == object+" ambiguous" {
+		if !stopCancel() {
+			return fail(ctx.Err())
+		}
+		cancel()
+		c.put(p)
+		return nil, errObjectMissing
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) != 3 {
+		return fail(fmt.Errorf("unexpected header %q", header))
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || size < 0 {
+		return fail(fmt.Errorf("unexpected header %q", header))
+	}
+
+	return &catFileObject{
+		Oid:        fields[0],
+		Type:       fields[1],
+		Size:       size,
+		cancel:     cancel,
+		ctx:        ctx,
+		pool:       c,
+		process:    p,
+		stopCancel: stopCancel,
+	}, nil
+}
+
+// take removes an idle process with key from the pool. The caller must
+// hold the lock.
+func (c *catFileBatchPool) take(key string) *catFileBatchProcess {
+	for elem := c.idle.Front(); elem != nil; elem = elem.Next() {
+		if p := elem.Value.(*catFileBatchProcess); p.key == key {
+			c.idle.Remove(elem)
+			catFileBatchIdle.Set(float64(c.idle.Len()))
+			if p.idleTimer != nil {
+				p.idleTimer.Stop()
+			}
+			return p
+		}
+	}
+	return nil
+}
+
+// put adds p to the pool, or stops it if the pool is full
+func (c *catFileBatchPool) put(p *catFileBatchProcess) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem := c.idle.PushFront(p)
+	if c.IdleTimeout > 0 {
+		p.idleTimer = time.AfterFunc(c.IdleTimeout, func() { c.expire(elem) })
+	}
+	c.evict()
+	c.broadcast()
+}
+
+func (c *catFileBatchPool) expire(elem *list.Element) {
+	c.Lock()
+	defer c.Unlock()
+
+	// The process may have been taken or evicted since the timer fired
+	for e := c.idle.Front(); e != nil; e = e.Next() {
+		if e == elem {
+			c.remove(elem)
+			return
+		}
+	}
+}
+
+// evict stops the least recently used processes beyond MaxIdle. The caller
+// must hold the lock.
+func (c *catFileBatchPool) evict() {
+	for c.idle.Len() > c.MaxIdle {
+		c.remove(c.idle.Back())
+	}
+	catFileBatchIdle.Set(float64(c.idle.Len()))
+}
+
+// remove stops the process in elem. The caller must hold the lock.
+func (c *catFileBatchPool) remove(elem *list.Element) {
+	p := c.idle.Remove(elem).(*catFileBatchProcess)
+	catFileBatchIdle.Set(float64(c.idle.Len()))
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+	}
+	// Do not make other requests wait for the process to exit
+	go c.stop(p)
+}
+
+// kill sends SIGTERM to the process group of p
+func (p *catFileBatchProcess) kill() {
+	if process := p.cmd.Process; process != nil && process.Pid > 0 {
+		syscall.Kill(-process.Pid, syscall.SIGTERM)
+	}
+}
+
+// stop ends p and waits for it
+func (p *catFileBatchProcess) stop() {
+	p.stopWatch()
+	p.stdin.Close()
+	helper.CleanUpProcessGroup(p.cmd)
+}
+
+// catFileObject reads the content of an object from a 'git cat-file
+// --batch' process. The first Read copies the whole object out of the
+// process and returns the process to the pool, so that slow clients do not
+// keep it busy. Closing an object that has not been read stops the
+// process. Close may be called while another goroutine reads; it
+// interrupts the copy instead of waiting for it.
+type catFileObject struct {
+	Oid  string
+	Type string
+	Size int64
+
+	closed int32  // Set by Close before it waits for Read
+	cancel func() // Kills the process while it is busy
+
+	mu         sync.Mutex
+	ctx        context.Context
+	pool       *catFileBatchPool
+	process    *catFileBatchProcess // Until the object is copied
+	stopCancel func() bool
+	content    io.Reader // The copy of the object
+	spoolFile  *os.File  // Holds content for big objects
+	err        error
+}
+
+var errCatFileObjectClosed = errors.New("catFileObject: closed")
+
+func (o *catFileObject) Read(b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.err != nil {
+		return 0, o.err
+	}
+	if o.content == nil {
+		if o.err = o.spool(); o.err != nil {
+			return 0, o.err
+		}
+	}
+
+	n, err := o.content.Read(b)
+	o.err = err
+	return n, err
+}
+
+// spool copies the object out of the process, into memory or into a
+// tempfile, and then returns the process to the pool
+func (o *catFileObject) spool() error {
+	var spool io.ReadWriter
+	if o.Size <= maxCatFileObjectInMemory {
+		spool = bytes.NewBuffer(make([]byte, 0, o.Size))
+	} else {
+		file, err := ioutil.TempFile("", "gitlab-workhorse-cat-file")
+		if err != nil {
+			return o.fail(err)
+		}
+		// Nothing is left behind if we crash
+		os.Remove(file.Name())
+		o.spoolFile = file
+		spool = file
+	}
+
+	_, err := io.CopyN(spool, o.process.stdout, o.Size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return o.fail(err)
+	}
+	if err := o.readTrailer(); err != nil {
+		return err
+	}
+
+	p := o.process
+	o.process = nil
+	if !o.stopCancel() {
+		// The process is being killed
+		o.pool.stop(p)
+		return o.interrupted(o.ctx.Err())
+	}
+	o.pool.put(p)
+	if err := o.ctx.Err(); err != nil {
+		return o.interrupted(err)
+	}
+
+	if o.spoolFile != nil {
+		if _, err := o.spoolFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	o.content = spool
+	return nil
+}
+
+// readTrailer reads the newline after the content
+func (o *catFileObject) readTrailer() error {
+	c, err := o.process.stdout.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return o.fail(err)
+	}
+	if c != '\n' {
+		return o.fail(fmt.Errorf("unexpected byte %q after object %s", c, o.Oid))
+	}
+	return nil
+}
+
+func (o *catFileObject) fail(err error) error {
+	p := o.process
+	o.process = nil
+	o.stopCancel()
+	o.pool.stop(p)
+	return o.interrupted(helper.NewProcessError(p.cmd, fmt.Errorf("git cat-file --batch: %v", err)))
+}
+
+// interrupted returns errCatFileObjectClosed instead of err if the copy
+// failed because the object was closed
+func (o *catFileObject) interrupted(err error) error {
+	if atomic.LoadInt32(&o.closed) != 0 {
+		return errCatFileObjectClosed
+	}
+	return err
+}
+
+// Close stops the process if the object has not been copied out of it.
+// Reads fail after Close.
+func (o *catFileObject) Close() error {
+	// Kill the process first, in case a Read is blocked on it
+	atomic.StoreInt32(&o.closed, 1)
+	o.cancel()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.err == nil || o.err == io.EOF {
+		o.err = errCatFileObjectClosed
+	}
+	if o.spoolFile != nil {
+		o.spoolFile.Close()
+		o.spoolFile = nil
+	}
+	if o.process == nil {
+		return nil // Returned to the pool, or stopped by fail
+	}
+
+	p := o.process
+	o.process = nil
+	o.stopCancel()
+	o.pool.stop(p)
+	return nil
+}
+
+// afterFunc calls f in its own goroutine once ctx is done. Calling the
+// returned stop function prevents that; it returns false if f has already
+// been started or stop was called before.
+func afterFunc(ctx context.Context, f func()) (stop func() bool) {
+	var mu sync.Mutex
+	started, stopped := false, false
+	stopCh := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopCh:
+			return
+		}
+		mu.Lock()
+		run := !stopped
+		started = run
+		mu.Unlock()
+		if run {
+			f()
+		}
+	}()
+
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if started || stopped {
+			return false
+		}
+		stopped = true
+		close(stopCh)
+		return true
+	}
+}
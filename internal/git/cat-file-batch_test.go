@@ -0,0 +1,326 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readCatFileObject(t *testing.T, pool *catFileBatchPool, repoPath string, object string) (*catFileBatchProcess, []byte) {
+	o, err := pool.open(context.Background(), nil, repoPath, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process := o.process
+	data, err := ioutil.ReadAll(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+	return process, data
+}
+
+func idleCatFileProcesses(pool *catFileBatchPool) int {
+	pool.Lock()
+	defer pool.Unlock()
+	return pool.idle.Len()
+}
+
+func TestCatFileBatchReusesProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-file-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath, blobId := setupBlobRepo(t, dir, []byte("hello world\n"))
+	pool := newCatFileBatchPool(CatFileBatchConfig{MaxIdle: 1})
+	defer pool.configure(CatFileBatchConfig{}) // Stop the idle processes
+
+	first, data := readCatFileObject(t, pool, repoPath, blobId)
+	if string(data) != "hello world\n" {
+		t.Fatalf("unexpected content %q", data)
+	}
+	if _, err := pool.open(context.Background(), nil, repoPath, strings.Repeat("0", 40)); err != errObjectMissing {
+		t.Fatalf("expected %v, got %v", errObjectMissing, err)
+	}
+	second, _ := readCatFileObject(t, pool, repoPath, blobId)
+	if first != second {
+		t.Fatal("expected the process to be reused")
+	}
+
+	// Another repository does not share the process, and the pool keeps
+	// only the most recently used one
+	otherDir := filepath.Join(dir, "other")
+	os.Mkdir(otherDir, 0755)
+	otherRepoPath, otherBlobId := setupBlobRepo(t, otherDir, []byte("other\n"))
+	third, _ := readCatFileObject(t, pool, otherRepoPath, otherBlobId)
+	if third == first {
+		t.Fatal("expected a process for the other repository")
+	}
+	if n := idleCatFileProcesses(pool); n != 1 {
+		t.Fatalf("expected 1 idle process, got %d", n)
+	}
+	if fourth, _ := readCatFileObject(t, pool, repoPath, blobId); fourth == first {
+		t.Fatal("expected the first process to be evicted")
+	}
+}
+
+func TestCatFileBatchRecoversFromCrashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-file-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath, blobId := setupBlobRepo(t, dir, []byte("hello world\n"))
+	pool := newCatFileBatchPool(CatFileBatchConfig{MaxIdle: 1})
+	defer pool.configure(CatFileBatchConfig{}) // Stop the idle processes
+
+	first, _ := readCatFileObject(t, pool, repoPath, blobId)
+	first.kill()
+	first.cmd.Wait()
+
+	second, data := readCatFileObject(t, pool, repoPath, blobId)
+	if second == first || string(data) != "hello world\n" {
+		t.Fatalf("expected a new process with the blob, got %q", data)
+	}
+}
+
+func TestCatFileBatchStopsBusyProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-file-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath, blobId := setupBlobRepo(t, dir, bytes.Repeat([]byte("x"), 2<<20))
+	pool := newCatFileBatchPool(CatFileBatchConfig{MaxIdle: 1})
+	defer pool.configure(CatFileBatchConfig{}) // Stop the idle processes
+
+	// Closed before it was read
+	o, err := pool.open(context.Background(), nil, repoPath, blobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+	if n := idleCatFileProcesses(pool); n != 0 {
+		t.Fatalf("expected no idle process, got %d", n)
+	}
+	if _, err := o.Read(make([]byte, 10)); err != errCatFileObjectClosed {
+		t.Fatalf("expected %v after Close, got %v", errCatFileObjectClosed, err)
+	}
+
+	// The request went away
+	ctx, cancel := context.WithCancel(context.Background())
+	o, err = pool.open(ctx, nil, repoPath, blobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := ioutil.ReadAll(o); err == nil {
+		t.Fatal("expected a read error after the request went away")
+	}
+	o.Close()
+	if n := idleCatFileProcesses(pool); n != 0 {
+		t.Fatalf("expected no idle process, got %d", n)
+	}
+}
+
+func TestCatFileBatchReleasesProcessesBeforeClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-file-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, size := range []int{100, maxCatFileObjectInMemory + 1} {
+		content := bytes.Repeat([]byte("x"), size)
+		sizeDir := filepath.Join(dir, fmt.Sprint(size))
+		os.Mkdir(sizeDir, 0755)
+		repoPath, blobId := setupBlobRepo(t, sizeDir, content)
+		pool := newCatFileBatchPool(CatFileBatchConfig{MaxIdle: 1, MaxPerRepository: 1})
+
+		// A slow client has read only the first bytes
+		slow, err := pool.open(context.Background(), nil, repoPath, blobId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := make([]byte, 10)
+		if _, err := io.ReadFull(slow, head); err != nil {
+			t.Fatal(err)
+		}
+		if n := idleCatFileProcesses(pool); n != 1 {
+			t.Fatalf("expected the process to be idle, got %d idle processes", n)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		o, err := pool.open(ctx, nil, repoPath, blobId)
+		cancel()
+		if err != nil {
+			t.Fatalf("expected the process of the slow client, got %v", err)
+		}
+		o.Close()
+
+		rest, err := ioutil.ReadAll(slow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(append(head, rest...), content) {
+			t.Fatalf("expected the whole object, got %d bytes", len(head)+len(rest))
+		}
+		slow.Close()
+		pool.configure(CatFileBatchConfig{}) // Stop the idle processes
+	}
+}
+
+func TestCatFileBatchIdleTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-file-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath, blobId := setupBlobRepo(t, dir, []byte("hello world\n"))
+	pool := newCatFileBatchPool(CatFileBatchConfig{MaxIdle: 1, IdleTimeout: 10 * time.Millisecond})
+	defer pool.configure(CatFileBatchConfig{}) // Stop the idle processes
+
+	readCatFileObject(t, pool, repoPath, blobId)
+	for deadline := time.Now().Add(5 * time.Second); idleCatFileProcesses(pool) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the idle process to be stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func runningCatFileProcesses(pool *catFileBatchPool) int {
+	pool.Lock()
+	defer pool.Unlock()
+	return pool.total
+}
+
+func TestCatFileBatchConcurrentClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-file-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath, blobId := setupBlobRepo(t, dir, bytes.Repeat([]byte("x"), 1<<20))
+	pool := newCatFileBatchPool(CatFileBatchConfig{MaxIdle: 1})
+	defer pool.configure(CatFileBatchConfig{}) // Stop the idle processes
+
+	o, err := pool.open(context.Background(), nil, repoPath, blobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, o)
+		done <- err
+	}()
+	o.Close()
+	if err := <-done; err != nil && err != errCatFileObjectClosed {
+		t.Fatalf("expected the whole object or %v, got %v", errCatFileObjectClosed, err)
+	}
+
+	// The process is reused only if the object was read to its end
+	if n := idleCatFileProcesses(pool); n > 1 {
+		t.Fatalf("expected at most 1 idle process, got %d", n)
+	}
+	if _, data := readCatFileObject(t, pool, repoPath, blobId); len(data) != 1<<20 {
+		t.Fatalf("expected the whole object, got %d bytes", len(data))
+	}
+}
+
+func TestCatFileBatchLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-file-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath, blobId := setupBlobRepo(t, dir, []byte("hello world\n"))
+	otherDir := filepath.Join(dir, "other")
+	os.Mkdir(otherDir, 0755)
+	otherRepoPath, otherBlobId := setupBlobRepo(t, otherDir, []byte("other\n"))
+
+	pool := newCatFileBatchPool(CatFileBatchConfig{MaxIdle: 2, MaxProcesses: 2, MaxPerRepository: 1})
+	defer pool.configure(CatFileBatchConfig{}) // Stop the idle processes
+
+	busy, err := pool.open(context.Background(), nil, repoPath, blobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The repository has its one process
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.open(ctx, nil, repoPath, blobId); err != context.DeadlineExceeded {
+		t.Fatalf("expected to wait until %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// A waiting request gets the process once it is idle
+	opened := make(chan *catFileObject)
+	go func() {
+		o, err := pool.open(context.Background(), nil, repoPath, blobId)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- o
+	}()
+	process := busy.process
+	ioutil.ReadAll(busy)
+	busy.Close()
+	o := <-opened
+	if o == nil {
+		t.FailNow()
+	}
+	if o.process != process {
+		t.Fatal("expected the idle process to be reused")
+	}
+	ioutil.ReadAll(o)
+	o.Close()
+
+	// Another repository may start one, and then the total is reached. An
+	// idle process is stopped to make room for a third repository.
+	readCatFileObject(t, pool, otherRepoPath, otherBlobId)
+	if n := runningCatFileProcesses(pool); n != 2 {
+		t.Fatalf("expected 2 processes, got %d", n)
+	}
+	thirdDir := filepath.Join(dir, "third")
+	os.Mkdir(thirdDir, 0755)
+	thirdRepoPath, thirdBlobId := setupBlobRepo(t, thirdDir, []byte("third\n"))
+	if _, data := readCatFileObject(t, pool, thirdRepoPath, thirdBlobId); string(data) != "third\n" {
+		t.Fatalf("unexpected content %q", data)
+	}
+	if n := runningCatFileProcesses(pool); n > 2 {
+		t.Fatalf("expected at most 2 processes, got %d", n)
+	}
+}
+
+func TestConfigureCatFileBatch(t *testing.T) {
+	defer ConfigureCatFileBatch(DefaultCatFileBatchConfig)
+
+	for _, cfg := range []CatFileBatchConfig{
+		{MaxIdle: -1},
+		{IdleTimeout: -time.Second},
+		{MaxProcesses: -1},
+		{MaxPerRepository: -1},
+	} {
+		if err := ConfigureCatFileBatch(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+	if err := ConfigureCatFileBatch(CatFileBatchConfig{MaxIdle: 1, MaxProcesses: 1, MaxPerRepository: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
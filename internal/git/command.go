@@ -1,16 +1,169 @@
 package git
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
 var execCommand = exec.Command
 
-// Git subprocess helpers
-func gitCommand(gl_id string, name string, args ...string) *exec.Cmd {
+// allowedGitEnv lists the environment variables that GitLab may set for
+// Git subprocesses, and checks their values
+var allowedGitEnv = map[string]func(string) error{
+	"GIT_ALTERNATE_OBJECT_DIRECTORIES": checkAbsolutePathList,
+	"GIT_CONFIG_PARAMETERS":            checkConfigParameters,
+	"GIT_OBJECT_DIRECTORY":             checkAbsolutePath,
+}
+
+// gitEnv validates the environment variables that GitLab wants to set for a
+// Git subprocess and returns them as NAME=value pairs
+func gitEnv(env map[string]string) ([]string, error) {
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		check, ok := allowedGitEnv[name]
+		if !ok {
+			return nil, fmt.Errorf("gitEnv: %s is not allowed", name)
+		}
+
+		value := env[name]
+		if strings.IndexByte(value, 0) >= 0 {
+			return nil, fmt.Errorf("gitEnv: %s contains a NUL byte", name)
+		}
+		if err := check(value); err != nil {
+			return nil, fmt.Errorf("gitEnv: %s: %v", name, err)
+		}
+
+		pairs = append(pairs, name+"="+value)
+	}
+	return pairs, nil
+}
+
+func checkAbsolutePath(p string) error {
+	if !filepath.IsAbs(p) {
+		return fmt.Errorf("%q is not an absolute path", p)
+	}
+	return nil
+}
+
+func checkAbsolutePathList(list string) error {
+	for _, p := range filepath.SplitList(list) {
+		if err := checkAbsolutePath(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowedGitConfig lists the configuration keys, in lower case, that GitLab
+// may set in GIT_CONFIG_PARAMETERS. Many other keys make Git run commands
+// of their choosing, e.g. core.hooksPath or uploadpack.packObjectsHook.
+var allowedGitConfig = map[string]bool{
+	"core.bigfilethreshold":    true,
+	"core.deltabasecachelimit": true,
+	"core.packedgitlimit":      true,
+	"core.packedgitwindowsize": true,
+	"pack.deltacachesize":      true,
+	"pack.threads":             true,
+	"pack.windowmemory":        true,
+	"receive.fsckobjects":      true,
+	"receive.maxinputsize":     true,
+	"transfer.fsckobjects":     true,
+	"uploadpack.allowfilter":   true,
+}
+
+// checkConfigParameters checks GIT_CONFIG_PARAMETERS, a list of
+// shell-quoted entries in the form Git writes them for 'git -c': either
+// 'key=value' or 'key'='value'.
+func checkConfigParameters(value string) error {
+	entries, err := parseConfigParameters(value)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		key := entry
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			key = entry[:i]
+		}
+		if !allowedGitConfig[strings.ToLower(key)] {
+			return fmt.Errorf("config key %q is not allowed", key)
+		}
+	}
+	return nil
+}
+
+// parseConfigParameters splits GIT_CONFIG_PARAMETERS into its entries. An
+// entry in the 'key'='value' form is returned as key=value.
+func parseConfigParameters(value string) ([]string, error) {
+	var entries []string
+	for {
+		value = strings.TrimLeft(value, " \t\n")
+		if value == "" {
+			return entries, nil
+		}
+
+		entry, rest, err := sqDequote(value)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(rest, "=") {
+			var v string
+			if v, rest, err = sqDequote(rest[1:]); err != nil {
+				return nil, err
+			}
+			entry += "=" + v
+		}
+		if rest != "" && !strings.ContainsAny(rest[:1], " \t\n") {
+			return nil, fmt.Errorf("invalid config parameters %q", value)
+		}
+
+		entries = append(entries, entry)
+		value = rest
+	}
+}
+
+// sqDequote reads one word quoted like Git's sq_quote at the start of s,
+// e.g. 'it'\”s', and returns it with the rest of s.
+func sqDequote(s string) (word string, rest string, err error) {
+	var b bytes.Buffer
+	for {
+		if !strings.HasPrefix(s, "'") {
+			return "", "", fmt.Errorf("expected quote in config parameters at %q", s)
+		}
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated quote in config parameters")
+		}
+		b.WriteString(s[1 : end+1])
+		s = s[end+2:]
+
+		// Git quotes ' and ! as '\'' and '\!' inside a quoted word
+		if len(s) >= 3 && s[0] == '\\' && (s[1] == '\'' || s[1] == '!') && s[2] == '\'' {
+			b.WriteByte(s[1])
+			s = s[2:]
+			continue
+		}
+		return b.String(), s, nil
+	}
+}
+
+// Git subprocess helpers. The entries of env, which must come from gitEnv,
+// are added to the environment of the command.
+func gitCommand(gl_id string, env []string, name string, args ...string) *exec.Cmd {
 	cmd := execCommand(name, args...)
 	// Start the command in its own process group (nice for signalling)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
@@ -22,7 +175,9 @@ func gitCommand(gl_id string, name string, args ...string) *exec.Cmd {
 		fmt.Sprintf("GL_ID=%s", gl_id),
 		fmt.Sprintf("GL_PROTOCOL=http"),
 	}
-	// If we don't do something with cmd.Stderr, Git errors will be lost
-	cmd.Stderr = os.Stderr
+	cmd.Env = append(cmd.Env, env...)
+	// If we don't do something with cmd.Stderr, Git errors will be lost. We
+	// keep them so that they can be logged with the request.
+	cmd.Stderr = helper.NewStderrBuffer()
 	return cmd
 }
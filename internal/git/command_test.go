@@ -0,0 +1,73 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGitEnv(t *testing.T) {
+	env, err := gitEnv(map[string]string{
+		"GIT_OBJECT_DIRECTORY":             "/repo.git/objects/incoming",
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES": "/repo.git/objects:/pool.git/objects",
+		"GIT_CONFIG_PARAMETERS":            "'core.bigfilethreshold=1m'",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES=/repo.git/objects:/pool.git/objects",
+		"GIT_CONFIG_PARAMETERS='core.bigfilethreshold=1m'",
+		"GIT_OBJECT_DIRECTORY=/repo.git/objects/incoming",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+}
+
+func TestGitEnvRejectsInvalid(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"GIT_DIR": "/repo.git"},
+		{"LD_PRELOAD": "/tmp/evil.so"},
+		{"GIT_OBJECT_DIRECTORY": "objects"},
+		{"GIT_ALTERNATE_OBJECT_DIRECTORIES": "/pool.git/objects:../other"},
+		{"GIT_CONFIG_PARAMETERS": "'a.b=c'\x00"},
+	} {
+		if _, err := gitEnv(env); err == nil {
+			t.Errorf("expected %v to be rejected", env)
+		}
+	}
+}
+
+func TestGitEnvConfigParameters(t *testing.T) {
+	for _, value := range []string{
+		"'core.bigfilethreshold=1m'",
+		"'core.bigFileThreshold'='1m' 'pack.threads'='2'",
+		" 'uploadpack.allowFilter=true'  ",
+		"'core.bigfilethreshold'='it'\\''s'",
+	} {
+		if _, err := gitEnv(map[string]string{"GIT_CONFIG_PARAMETERS": value}); err != nil {
+			t.Errorf("%q: %v", value, err)
+		}
+	}
+}
+
+func TestGitEnvRejectsCommandConfig(t *testing.T) {
+	for _, value := range []string{
+		"'core.hooksPath=/tmp/hooks'",
+		"'core.hookspath'='/tmp/hooks'",
+		"'uploadpack.packObjectsHook=/tmp/evil'",
+		"'core.fsmonitor=/tmp/evil'",
+		"'core.sshCommand=/tmp/evil'",
+		"'core.gitProxy=/tmp/evil'",
+		"'protocol.ext.allow=always'",
+		"'core.bigfilethreshold=1m' 'core.hooksPath=/tmp/hooks'",
+		"'core.bigfilethreshold=1m''core.hooksPath=/tmp/hooks'",
+		"core.hooksPath=/tmp/hooks",
+		"'core.hooksPath",
+	} {
+		if _, err := gitEnv(map[string]string{"GIT_CONFIG_PARAMETERS": value}); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
@@ -15,6 +15,7 @@ type diffParams struct {
 	RepoPath string
 	ShaFrom  string
 	ShaTo    string
+	GitEnv   map[string]string
 }
 
 var SendDiff = &diff{"git-diff:"}
@@ -28,18 +29,26 @@ func (d *diff) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 
 	log.Printf("SendDiff: sending diff between %q and %q for %q", params.ShaFrom, params.ShaTo, r.URL.Path)
 
-	gitDiffCmd := gitCommand("", "git", "--git-dir="+params.RepoPath, "diff", params.ShaFrom, params.ShaTo)
+	env, err := gitEnv(params.GitEnv)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendDiff: %v", err))
+		return
+	}
+
+	gitDiffCmd := gitCommand("", env, "git", "--git-dir="+params.RepoPath, "diff", params.ShaFrom, params.ShaTo)
 	stdout, err := gitDiffCmd.StdoutPipe()
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("SendDiff: create stdout pipe: %v", err))
 		return
 	}
 
+	helper.LimitProcess("diff", gitDiffCmd)
 	if err := gitDiffCmd.Start(); err != nil {
 		helper.Fail500(w, r, fmt.Errorf("SendDiff: start %v: %v", gitDiffCmd.Args, err))
 		return
 	}
 	defer helper.CleanUpProcessGroup(gitDiffCmd)
+	defer helper.WatchProcessGroup(r.Context(), "diff", gitDiffCmd)()
 
 	w.Header().Del("Content-Length")
 	if _, err := io.Copy(w, stdout); err != nil {
@@ -50,7 +59,7 @@ func (d *diff) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 		return
 	}
 	if err := gitDiffCmd.Wait(); err != nil {
-		helper.LogError(r, fmt.Errorf("SendDiff: wait for %v: %v", gitDiffCmd.Args, err))
+		helper.LogError(r, helper.NewProcessError(gitDiffCmd, fmt.Errorf("SendDiff: wait for %v: %v", gitDiffCmd.Args, err)))
 		return
 	}
 }
@@ -0,0 +1,202 @@
+/*
+In this file we handle the read-only Git 'dumb HTTP' protocol
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// Everything a dumb HTTP client may request, relative to the repository URL
+var dumbHTTPPath = regexp.MustCompile(`\A(.*\.git)/(HEAD|info/refs|objects/info/packs|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(pack|idx))\z`)
+
+// DumbHTTPHandler serves the files that the 'dumb' Git HTTP protocol reads
+// straight from the repository directory.
+func DumbHTTPHandler(a *api.API) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matches := dumbHTTPPath.FindStringSubmatch(r.URL.Path)
+		if matches == nil {
+			http.Error(w, "Not Found", 404)
+			return
+		}
+		repoURLPath, file := matches[1], matches[2]
+
+		// GitLab only knows how to authorize 'smart' HTTP requests. Reading
+		// files with the dumb protocol needs the same access as a fetch, so
+		// we ask permission for a fetch.
+		authReq := *r
+		authURL := *r.URL
+		authURL.Path = repoURLPath + "/info/refs"
+		authURL.RawPath = ""
+		authURL.RawQuery = "service=git-upload-pack"
+		authReq.URL = &authURL
+
+		repoPreAuthorizeHandler(a, func(w http.ResponseWriter, _ *http.Request, ar *api.Response) {
+			handleDumbHTTP(w, r, ar, file)
+		}).ServeHTTP(w, &authReq)
+	})
+}
+
+func handleDumbHTTP(w http.ResponseWriter, r *http.Request, a *api.Response, file string) {
+	if reason := dumbHTTPUnsupported(a); reason != "" {
+		log.Printf("handleDumbHTTP: %s %q: %s", r.Method, r.RequestURI, reason)
+		http.Error(w, reason, 403)
+		return
+	}
+
+	switch file {
+	case "info/refs":
+		handleDumbInfoRefs(w, r, a)
+		return
+	case "objects/info/packs":
+		handleDumbInfoPacks(w, r, a)
+		return
+	}
+
+	path := filepath.Join(a.RepoPath, file)
+	if !(path == filepath.Join(a.RepoPath, "HEAD") || strings.HasPrefix(path, filepath.Join(a.RepoPath, "objects")+"/")) {
+		helper.Fail500(w, r, fmt.Errorf("handleDumbHTTP: invalid path %q", file))
+		return
+	}
+
+	// Lstat so that we do not follow symlinks out of the repository
+	if fi, err := os.Lstat(path); err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	content, fi, err := helper.OpenFile(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer content.Close()
+
+	switch {
+	case file == "HEAD":
+		w.Header().Set("Content-Type", "text/plain")
+		helper.SetNoCacheHeaders(w.Header())
+	case strings.HasSuffix(file, ".pack"):
+		w.Header().Set("Content-Type", "application/x-git-packed-objects")
+		setDumbHTTPCacheForever(w)
+	case strings.HasSuffix(file, ".idx"):
+		w.Header().Set("Content-Type", "application/x-git-packed-objects-toc")
+		setDumbHTTPCacheForever(w)
+	default:
+		w.Header().Set("Content-Type", "application/x-git-loose-object")
+		setDumbHTTPCacheForever(w)
+	}
+
+	http.ServeContent(w, r, "", fi.ModTime(), content)
+}
+
+// dumbHTTPUnsupported returns why we cannot serve the repository of a to
+// dumb HTTP clients, if we cannot. These clients read objects and packs as
+// they are, so we cannot keep the objects of hidden refs from them, and
+// they cannot follow alternates to the object directories of object pools.
+func dumbHTTPUnsupported(a *api.Response) string {
+	if newRefFilter(a) != nil {
+		return "dumb HTTP is not available for repositories with hidden refs"
+	}
+	if a.GitEnv["GIT_OBJECT_DIRECTORY"] != "" || a.GitEnv["GIT_ALTERNATE_OBJECT_DIRECTORIES"] != "" {
+		return "dumb HTTP is not available for repositories with alternate object directories"
+	}
+	if alternates, err := ioutil.ReadFile(filepath.Join(a.RepoPath, "objects/info/alternates")); err == nil && len(bytes.TrimSpace(alternates)) > 0 {
+		return "dumb HTTP is not available for repositories with alternate object directories"
+	}
+	return ""
+}
+
+// Objects and packs are named after their content so they never change
+func setDumbHTTPCacheForever(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "private, max-age=31536000")
+}
+
+// handleDumbInfoRefs writes the same output as 'git update-server-info'
+// would put in info/refs. We generate it on the fly because GitLab does not
+// keep that file up to date.
+func handleDumbInfoRefs(w http.ResponseWriter, r *http.Request, a *api.Response) {
+	env, err := gitEnv(a.GitEnv)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("handleDumbInfoRefs: %v", err))
+		return
+	}
+
+	cmd := gitCommand("", env, "git", "--git-dir="+a.RepoPath, "for-each-ref", "--format=%(objectname) %(refname) %(*objectname)")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("handleDumbInfoRefs: stdout pipe: %v", err))
+		return
+	}
+	helper.LimitProcess("for-each-ref", cmd)
+	if err := cmd.Start(); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("handleDumbInfoRefs: start %v: %v", cmd.Args, err))
+		return
+	}
+	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(r.Context(), "for-each-ref", cmd)()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	helper.SetNoCacheHeaders(w.Header())
+	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", fields[0], fields[1]); err != nil {
+			helper.LogError(r, &copyError{fmt.Errorf("handleDumbInfoRefs: write: %v", err)})
+			return
+		}
+		if len(fields) == 3 {
+			// Annotated tag: also list the object it points to
+			if _, err := fmt.Fprintf(w, "%s\t%s^{}\n", fields[2], fields[1]); err != nil {
+				helper.LogError(r, &copyError{fmt.Errorf("handleDumbInfoRefs: write: %v", err)})
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		helper.LogError(r, fmt.Errorf("handleDumbInfoRefs: read output of %v: %v", cmd.Args, err))
+		return
+	}
+
+	if err := cmd.Wait(); err != nil {
+		helper.LogError(r, helper.NewProcessError(cmd, fmt.Errorf("handleDumbInfoRefs: wait for %v: %v", cmd.Args, err)))
+		return
+	}
+}
+
+// handleDumbInfoPacks writes the same output as 'git update-server-info'
+// would put in objects/info/packs.
+func handleDumbInfoPacks(w http.ResponseWriter, r *http.Request, a *api.Response) {
+	packs, err := filepath.Glob(filepath.Join(a.RepoPath, "objects/pack/pack-*.pack"))
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("handleDumbInfoPacks: %v", err))
+		return
+	}
+	sort.Strings(packs)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	helper.SetNoCacheHeaders(w.Header())
+	for _, pack := range packs {
+		fmt.Fprintf(w, "P %s\n", filepath.Base(pack))
+	}
+	fmt.Fprint(w, "\n")
+}
@@ -0,0 +1,147 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestHandleDumbHTTP(t *testing.T) {
+	repoPath, err := ioutil.TempDir("", "gitlab-workhorse-dumb-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoPath)
+
+	packName := "pack-" + someID + ".pack"
+	for name, content := range map[string]string{
+		"HEAD":                             "ref: refs/heads/master\n",
+		"config":                           "[core]\n",
+		"objects/12/" + someID[2:]:         "loose object",
+		"objects/pack/" + packName:         "PACK",
+		"objects/pack/pack-other.keep":     "",
+		"objects/info/alternates-not-used": "",
+	} {
+		path := filepath.Join(repoPath, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Symlinks must not be followed, even inside objects/
+	if err := os.MkdirAll(filepath.Join(repoPath, "objects/ab"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(repoPath, "config"), filepath.Join(repoPath, "objects/ab/"+someID[2:])); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &api.Response{RepoPath: repoPath}
+	for _, tc := range []struct {
+		file        string
+		code        int
+		body        string
+		contentType string
+	}{
+		{"HEAD", 200, "ref: refs/heads/master\n", "text/plain"},
+		{"objects/12/" + someID[2:], 200, "loose object", "application/x-git-loose-object"},
+		{"objects/pack/" + packName, 200, "PACK", "application/x-git-packed-objects"},
+		{"objects/info/packs", 200, "P " + packName + "\n\n", "text/plain; charset=utf-8"},
+		{"objects/ab/" + someID[2:], 404, "", ""},
+		{"objects/cd/" + someID[2:], 404, "", ""},
+	} {
+		w := httptest.NewRecorder()
+		handleDumbHTTP(w, &http.Request{Method: "GET", Header: http.Header{}}, a, tc.file)
+
+		if w.Code != tc.code {
+			t.Errorf("%s: expected status %d, got %d", tc.file, tc.code, w.Code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		if w.Body.String() != tc.body {
+			t.Errorf("%s: expected body %q, got %q", tc.file, tc.body, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("%s: expected content type %q, got %q", tc.file, tc.contentType, ct)
+		}
+	}
+}
+
+func TestHandleDumbInfoRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitlab-workhorse-dumb-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath := filepath.Join(dir, "repo.git")
+	runGit(t, dir, nil, "init", "-q", "--bare", repoPath)
+	tree := strings.TrimSpace(string(runGit(t, repoPath, nil, "mktree")))
+	commit := strings.TrimSpace(string(runGit(t, repoPath, nil, "commit-tree", "-m", "test", tree)))
+	runGit(t, repoPath, nil, "update-ref", "refs/heads/master", commit)
+
+	a := &api.Response{RepoPath: repoPath}
+	w := httptest.NewRecorder()
+	handleDumbHTTP(w, &http.Request{Method: "GET", Header: http.Header{}}, a, "info/refs")
+
+	if w.Code != 200 {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if expected := commit + "\trefs/heads/master\n"; w.Body.String() != expected {
+		t.Fatalf("expected body %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestHandleDumbHTTPUnsupported(t *testing.T) {
+	repoPath, err := ioutil.TempDir("", "gitlab-workhorse-dumb-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoPath)
+
+	pooledPath := filepath.Join(repoPath, "pooled.git")
+	if err := os.MkdirAll(filepath.Join(pooledPath, "objects/info"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pooledPath, "objects/info/alternates"), []byte("/pool.git/objects\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range []*api.Response{
+		{RepoPath: repoPath, HideRefs: []string{"refs/hidden"}},
+		{RepoPath: repoPath, AllowRefs: []string{"refs/heads"}},
+		{RepoPath: repoPath, GitEnv: map[string]string{"GIT_ALTERNATE_OBJECT_DIRECTORIES": "/pool.git/objects"}},
+		{RepoPath: pooledPath},
+	} {
+		for _, file := range []string{"HEAD", "info/refs", "objects/info/packs"} {
+			w := httptest.NewRecorder()
+			handleDumbHTTP(w, &http.Request{Method: "GET", Header: http.Header{}}, a, file)
+			if w.Code != 403 {
+				t.Errorf("%+v %s: expected status 403, got %d", a, file, w.Code)
+			}
+		}
+	}
+}
+
+func TestDumbHTTPPath(t *testing.T) {
+	for _, path := range []string{
+		"/group/project.git/objects/../config",
+		"/group/project.git/objects/12/short",
+		"/group/project.git/config",
+		"/group/project.git/objects/pack/pack-" + someID + ".keep",
+	} {
+		if dumbHTTPPath.MatchString(path) {
+			t.Errorf("expected %q not to be served", path)
+		}
+	}
+}
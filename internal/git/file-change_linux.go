@@ -0,0 +1,14 @@
+package git
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileChangeID returns the inode and change time of a file
+func fileChangeID(fi os.FileInfo) (inode uint64, ctime int64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino, syscall.TimespecToNsec(st.Ctim)
+	}
+	return 0, 0
+}
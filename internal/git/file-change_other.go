@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package git
+
+import "os"
+
+// fileChangeID returns zeros: we only use the inode and change time on Linux
+func fileChangeID(fi os.FileInfo) (inode uint64, ctime int64) {
+	return 0, 0
+}
@@ -15,6 +15,7 @@ type patchParams struct {
 	RepoPath string
 	ShaFrom  string
 	ShaTo    string
+	GitEnv   map[string]string
 }
 
 var SendPatch = &patch{"git-format-patch:"}
@@ -28,8 +29,14 @@ func (p *patch) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 
 	log.Printf("SendPatch: sending patch between %q and %q for %q", params.ShaFrom, params.ShaTo, r.URL.Path)
 
+	env, err := gitEnv(params.GitEnv)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendPatch: %v", err))
+		return
+	}
+
 	gitRange := fmt.Sprintf("%s..%s", params.ShaFrom, params.ShaTo)
-	gitPatchCmd := gitCommand("", "git", "--git-dir="+params.RepoPath, "format-patch", gitRange, "--stdout")
+	gitPatchCmd := gitCommand("", env, "git", "--git-dir="+params.RepoPath, "format-patch", gitRange, "--stdout")
 
 	stdout, err := gitPatchCmd.StdoutPipe()
 	if err != nil {
@@ -37,11 +44,13 @@ func (p *patch) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 		return
 	}
 
+	helper.LimitProcess("format-patch", gitPatchCmd)
 	if err := gitPatchCmd.Start(); err != nil {
 		helper.Fail500(w, r, fmt.Errorf("SendPatch: start %v: %v", gitPatchCmd.Args, err))
 		return
 	}
 	defer helper.CleanUpProcessGroup(gitPatchCmd)
+	defer helper.WatchProcessGroup(r.Context(), "format-patch", gitPatchCmd)()
 
 	w.Header().Del("Content-Length")
 	if _, err := io.Copy(w, stdout); err != nil {
@@ -49,7 +58,7 @@ func (p *patch) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 		return
 	}
 	if err := gitPatchCmd.Wait(); err != nil {
-		helper.LogError(r, fmt.Errorf("SendPatch: wait for %v: %v", gitPatchCmd.Args, err))
+		helper.LogError(r, helper.NewProcessError(gitPatchCmd, fmt.Errorf("SendPatch: wait for %v: %v", gitPatchCmd.Args, err)))
 		return
 	}
 }
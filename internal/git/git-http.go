@@ -16,15 +16,23 @@ import (
 	"strings"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
-func ReceivePack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleReceivePack", handleReceivePack)
+func ReceivePack(a *api.API, cfg *config.Config) http.Handler {
+	scanner := newPushScanner(cfg)
+	return postRPCHandler(a, "handleReceivePack", func(w *GitHttpResponseWriter, r *http.Request, ar *api.Response) (int64, error) {
+		return handleReceivePack(w, r, ar, scanner)
+	})
 }
 
-func UploadPack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleUploadPack", handleUploadPack)
+func UploadPack(a *api.API, cfg *config.Config) http.Handler {
+	queue := newUploadPackQueue(cfg)
+	return postRPCHandler(a, "handleUploadPack", func(w *GitHttpResponseWriter, r *http.Request, ar *api.Response) (int64, error) {
+		ar.UploadPackPolicy = mergeUploadPackPolicy(cfg.UploadPackPolicy, ar.UploadPackPolicy)
+		return handleUploadPack(w, r, ar, queue)
+	})
 }
 
 func postRPCHandler(a *api.API, name string, handler func(*GitHttpResponseWriter, *http.Request, *api.Response) (int64, error)) http.Handler {
@@ -39,7 +47,7 @@ func postRPCHandler(a *api.API, name string, handler func(*GitHttpResponseWriter
 
 		writtenIn, err = handler(w, r, ar)
 		if err != nil {
-			helper.LogError(r, fmt.Errorf("%s: %v", name, err))
+			helper.LogError(r, helper.PrefixError(name, err))
 		}
 	})
 }
@@ -70,7 +78,10 @@ func repoPreAuthorizeHandler(myAPI *api.API, handleFunc api.HandleFunc) http.Han
 	}, "")
 }
 
-func setupGitCommand(action string, a *api.Response, options ...string) (cmd *exec.Cmd, stdin io.WriteCloser, stdout io.ReadCloser, err error) {
+// setupGitCommand starts 'git <action> --stateless-rpc'. Each entry in
+// gitConfig is a name=value pair passed to Git with '-c'; each entry in
+// extraEnv is a NAME=value pair added to the environment of Git.
+func setupGitCommand(action string, a *api.Response, gitConfig []string, extraEnv []string, options ...string) (cmd *exec.Cmd, stdin io.WriteCloser, stdout io.ReadCloser, err error) {
 	// Don't leak pipes when we return early after an error
 	defer func() {
 		if err == nil {
@@ -84,11 +95,20 @@ func setupGitCommand(action string, a *api.Response, options ...string) (cmd *ex
 		}
 	}()
 
+	env, err := gitEnv(a.GitEnv)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	// Prepare our Git subprocess
-	args := []string{subCommand(action), "--stateless-rpc"}
+	var args []string
+	for _, c := range gitConfig {
+		args = append(args, "-c", c)
+	}
+	args = append(args, subCommand(action), "--stateless-rpc")
 	args = append(args, options...)
 	args = append(args, a.RepoPath)
-	cmd = gitCommand(a.GL_ID, "git", args...)
+	cmd = gitCommand(a.GL_ID, append(env, extraEnv...), "git", args...)
 	stdout, err = cmd.StdoutPipe()
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("stdout pipe: %v", err)
@@ -99,6 +119,7 @@ func setupGitCommand(action string, a *api.Response, options ...string) (cmd *ex
 		return nil, nil, nil, fmt.Errorf("stdin pipe: %v", err)
 	}
 
+	helper.LimitProcess(subCommand(action), cmd)
 	if err = cmd.Start(); err != nil {
 		return nil, nil, nil, fmt.Errorf("start %v: %v", cmd.Args, err)
 	}
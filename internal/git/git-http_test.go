@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
@@ -32,11 +33,15 @@ func createTestPayload() []byte {
 }
 
 func TestHandleUploadPack(t *testing.T) {
-	testHandlePostRpc(t, "git-upload-pack", handleUploadPack)
+	testHandlePostRpc(t, "git-upload-pack", func(w *GitHttpResponseWriter, r *http.Request, a *api.Response) (int64, error) {
+		return handleUploadPack(w, r, a, nil)
+	})
 }
 
 func TestHandleReceivePack(t *testing.T) {
-	testHandlePostRpc(t, "git-receive-pack", handleReceivePack)
+	testHandlePostRpc(t, "git-receive-pack", func(w *GitHttpResponseWriter, r *http.Request, a *api.Response) (int64, error) {
+		return handleReceivePack(w, r, a, nil)
+	})
 }
 
 func testHandlePostRpc(t *testing.T, action string, handler func(*GitHttpResponseWriter, *http.Request, *api.Response) (int64, error)) {
@@ -117,3 +122,66 @@ func TestGitCommandProcess(t *testing.T) {
 		io.Copy(os.Stdout, os.Stdin)
 	}
 }
+
+func TestHandleReceivePackExceedingPackSize(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.Command }()
+
+	body := &bytes.Buffer{}
+	pktLine(body, "0000000000000000000000000000000000000000 1234567890123456789012345678901234567890 refs/heads/master\x00report-status\n")
+	pktFlush(body)
+	body.Write(createTestPayload())
+
+	req, err := http.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &api.Response{GL_ID: GL_ID, MaxPackSize: 1000}
+
+	rr := httptest.NewRecorder()
+	if _, err := handleReceivePack(NewGitHttpResponseWriter(rr), req, resp, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+
+	expected := "unpack pack exceeds maximum allowed size (limit 1000 bytes)\n"
+	if !strings.Contains(rr.Body.String(), expected) {
+		t.Fatalf("expected response to contain %q, got %q", expected, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "00000000000") {
+		t.Fatal("expected git output to be discarded")
+	}
+}
+
+func TestHandleReceivePackTooManyPushOptions(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.Command }()
+
+	body := &bytes.Buffer{}
+	pktLine(body, "0000000000000000000000000000000000000000 1234567890123456789012345678901234567890 refs/heads/master\x00report-status push-options\n")
+	pktFlush(body)
+	for i := 0; i <= maxPushOptions; i++ {
+		pktLine(body, "ci.skip\n")
+	}
+	pktFlush(body)
+	body.Write(createTestPayload())
+
+	req, err := http.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	if _, err := handleReceivePack(NewGitHttpResponseWriter(rr), req, &api.Response{GL_ID: GL_ID}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fmt.Sprintf("ng refs/heads/master too many push options: %d, maximum is %d\n", maxPushOptions+1, maxPushOptions)
+	if !strings.Contains(rr.Body.String(), expected) {
+		t.Fatalf("expected response to contain %q, got %q", expected, rr.Body.String())
+	}
+}
@@ -0,0 +1,298 @@
+package git
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	infoRefsCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_info_refs_cache_requests",
+			Help: "How many Git ref advertisements have been looked up in the info/refs cache, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+
+	infoRefsCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_git_info_refs_cache_bytes",
+		Help: "Number of bytes of Git ref advertisements currently held in the info/refs cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(infoRefsCacheRequests)
+	prometheus.MustRegister(infoRefsCacheBytes)
+}
+
+// The advertisement cache is shared by all handlers so that a push can
+// invalidate the advertisements of its repository.
+var infoRefsCache = newAdvertisementCache()
+
+type advertisementKey struct {
+	repoPath string
+	service  string
+	// env holds the Git environment, which can change the advertisement
+	env string
+}
+
+type advertisement struct {
+	key         advertisementKey
+	fingerprint string
+	data        []byte
+}
+
+// advertisementCache holds the output of 'git <service> --advertise-refs'
+// and evicts the least recently used entries to stay within a byte limit.
+type advertisementCache struct {
+	sync.Mutex
+	entries map[advertisementKey]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+func newAdvertisementCache() *advertisementCache {
+	return &advertisementCache{
+		entries: make(map[advertisementKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached advertisement for key if it was stored with the
+// same refs fingerprint.
+func (c *advertisementCache) get(key advertisementKey, fingerprint string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		infoRefsCacheRequests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	entry := elem.Value.(*advertisement)
+	if entry.fingerprint != fingerprint {
+		c.remove(elem)
+		infoRefsCacheRequests.WithLabelValues("stale").Inc()
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	infoRefsCacheRequests.WithLabelValues("hit").Inc()
+	return entry.data, true
+}
+
+func (c *advertisementCache) put(key advertisementKey, fingerprint string, data []byte, maxSize int64) {
+	if int64(len(data)) > maxSize {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+
+	c.entries[key] = c.lru.PushFront(&advertisement{key: key, fingerprint: fingerprint, data: data})
+	c.size += int64(len(data))
+
+	for c.size > maxSize {
+		c.remove(c.lru.Back())
+	}
+	infoRefsCacheBytes.Set(float64(c.size))
+}
+
+// invalidate drops all advertisements of the repository at repoPath
+func (c *advertisementCache) invalidate(repoPath string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for key, elem := range c.entries {
+		if key.repoPath == repoPath {
+			c.remove(elem)
+		}
+	}
+	infoRefsCacheBytes.Set(float64(c.size))
+}
+
+func (c *advertisementCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*advertisement)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+// Walking the loose refs costs a stat per ref on every request. Above this
+// many loose refs we do not cache, which is rare because Git packs refs.
+const maxFingerprintLooseRefs = 10000
+
+// Git follows alternates of alternates this deep
+const maxAlternateDepth = 5
+
+var errTooManyLooseRefs = errors.New("too many loose refs to fingerprint")
+
+// refsFingerprint summarizes the file metadata of everything that goes
+// into a ref advertisement. It changes whenever Git updates a ref, without
+// us having to read the refs. Git also advertises the refs of alternate
+// repositories, such as object pools, so their refs count too. These are
+// the repositories of the object directories in env and in the alternates
+// files. It returns errTooManyLooseRefs if that is too expensive.
+func refsFingerprint(repoPath string, env map[string]string) (string, error) {
+	h := sha1.New()
+	looseRefs := 0
+
+	if err := writeRefsFingerprint(h, repoPath, &looseRefs); err != nil {
+		return "", err
+	}
+
+	objectDir := env["GIT_OBJECT_DIRECTORY"]
+	if objectDir == "" {
+		objectDir = filepath.Join(repoPath, "objects")
+	}
+	fmt.Fprintf(h, "objects %s\n", objectDir)
+	var envAlternates []string
+	if list := env["GIT_ALTERNATE_OBJECT_DIRECTORIES"]; list != "" {
+		envAlternates = filepath.SplitList(list)
+	}
+
+	alternates, err := alternateObjectDirs(h, objectDir, envAlternates)
+	if err != nil {
+		return "", err
+	}
+	for _, alternate := range alternates {
+		fmt.Fprintf(h, "alternate %s\n", alternate)
+		if err := writeRefsFingerprint(h, filepath.Dir(alternate), &looseRefs); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func writeRefsFingerprint(h hash.Hash, repoPath string, looseRefs *int) error {
+	for _, name := range []string{"HEAD", "packed-refs"} {
+		if err := writeOptionalFileFingerprint(h, filepath.Join(repoPath, name)); err != nil {
+			return err
+		}
+	}
+
+	return filepath.Walk(filepath.Join(repoPath, "refs"), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == filepath.Join(repoPath, "refs") {
+			// An alternate object directory need not be a repository
+			fmt.Fprintf(h, "%s -\n", path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if *looseRefs++; *looseRefs > maxFingerprintLooseRefs {
+			return errTooManyLooseRefs
+		}
+		writeFileFingerprint(h, path, fi)
+		return nil
+	})
+}
+
+// alternateObjectDirs returns the alternate object directories of
+// objectDir, those in envAlternates, and the alternates of these, like Git
+// finds them. It adds the alternates files that it reads to h.
+func alternateObjectDirs(h hash.Hash, objectDir string, envAlternates []string) ([]string, error) {
+	seen := map[string]bool{filepath.Clean(objectDir): true}
+	var result []string
+
+	type alternate struct {
+		dir   string
+		depth int
+	}
+	var queue []alternate
+	add := func(dirs []string, depth int) {
+		for _, dir := range dirs {
+			if dir = filepath.Clean(dir); !seen[dir] {
+				seen[dir] = true
+				result = append(result, dir)
+				queue = append(queue, alternate{dir, depth})
+			}
+		}
+	}
+
+	dirs, err := readAlternates(h, objectDir)
+	if err != nil {
+		return nil, err
+	}
+	add(envAlternates, 1)
+	add(dirs, 1)
+
+	for len(queue) > 0 {
+		a := queue[0]
+		queue = queue[1:]
+		if a.depth >= maxAlternateDepth {
+			continue
+		}
+		dirs, err := readAlternates(h, a.dir)
+		if err != nil {
+			return nil, err
+		}
+		add(dirs, a.depth+1)
+	}
+	return result, nil
+}
+
+// readAlternates returns the object directories listed in
+// info/alternates of objectDir, and adds the file to h
+func readAlternates(h hash.Hash, objectDir string) ([]string, error) {
+	path := filepath.Join(objectDir, "info/alternates")
+	if err := writeOptionalFileFingerprint(h, path); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objectDir, line)
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs, nil
+}
+
+func writeOptionalFileFingerprint(h hash.Hash, path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(h, "%s -\n", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	writeFileFingerprint(h, path, fi)
+	return nil
+}
+
+// writeFileFingerprint adds the metadata of a file to h. The inode and
+// change time catch a file that is replaced within one tick of the
+// modification time with one of the same size.
+func writeFileFingerprint(h hash.Hash, name string, fi os.FileInfo) {
+	inode, ctime := fileChangeID(fi)
+	fmt.Fprintf(h, "%s %d %d %d %d\n", name, fi.Size(), fi.ModTime().UnixNano(), inode, ctime)
+}
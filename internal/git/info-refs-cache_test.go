@@ -0,0 +1,195 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdvertisementCache(t *testing.T) {
+	c := newAdvertisementCache()
+	key1 := advertisementKey{repoPath: "/repo1.git", service: "git-upload-pack"}
+	key2 := advertisementKey{repoPath: "/repo2.git", service: "git-upload-pack"}
+
+	c.put(key1, "fp1", []byte("0123456789"), 15)
+	if data, ok := c.get(key1, "fp1"); !ok || string(data) != "0123456789" {
+		t.Fatalf("expected hit, got %q %v", data, ok)
+	}
+	if _, ok := c.get(key1, "fp2"); ok {
+		t.Fatal("expected stale fingerprint to miss")
+	}
+	if _, ok := c.get(key1, "fp1"); ok {
+		t.Fatal("expected stale entry to be removed")
+	}
+
+	c.put(key1, "fp1", []byte("0123456789"), 15)
+	c.put(key2, "fp1", []byte("0123456789"), 15)
+	if _, ok := c.get(key1, "fp1"); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+	if c.size != 10 {
+		t.Fatalf("expected cache size 10, got %d", c.size)
+	}
+
+	c.invalidate("/repo2.git")
+	if _, ok := c.get(key2, "fp1"); ok || c.size != 0 {
+		t.Fatal("expected entry to be invalidated")
+	}
+}
+
+func TestRefsFingerprint(t *testing.T) {
+	repoPath, err := ioutil.TempDir("", "gitlab-workhorse-refs-fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoPath)
+
+	if err := os.MkdirAll(filepath.Join(repoPath, "refs/heads"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := refsFingerprint(repoPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(repoPath, "refs/heads/master"), []byte(someID+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := refsFingerprint(repoPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before == after {
+		t.Fatal("expected fingerprint to change when a ref is created")
+	}
+}
+
+func TestRefsFingerprintAlternates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitlab-workhorse-refs-fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath := filepath.Join(dir, "repo.git")
+	poolPath := filepath.Join(dir, "pool.git")
+	for _, path := range []string{repoPath + "/refs/heads", repoPath + "/objects/info", poolPath + "/refs/heads", poolPath + "/objects"} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(repoPath, "objects/info/alternates"), []byte("../../pool.git/objects\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := refsFingerprint(repoPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(poolPath, "refs/heads/master"), []byte(someID+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := refsFingerprint(repoPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before == after {
+		t.Fatal("expected fingerprint to change when a ref of an alternate is created")
+	}
+}
+
+func TestRefsFingerprintReplacedRef(t *testing.T) {
+	repoPath, err := ioutil.TempDir("", "gitlab-workhorse-refs-fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoPath)
+
+	ref := filepath.Join(repoPath, "refs/heads/master")
+	if err := os.MkdirAll(filepath.Dir(ref), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ref, []byte(someID+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := refsFingerprint(repoPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like Git, write a lock file and rename it over the ref. The new ref
+	// has the same size and modification time.
+	lock := ref + ".lock"
+	if err := ioutil.WriteFile(lock, []byte(strings.Repeat("1", 40)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(lock, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(lock, ref); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := refsFingerprint(repoPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before == after {
+		t.Fatal("expected fingerprint to change when a ref is replaced")
+	}
+}
+
+func TestRefsFingerprintEnvAlternates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitlab-workhorse-refs-fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath := filepath.Join(dir, "repo.git")
+	poolPath := filepath.Join(dir, "pool.git")
+	nestedPath := filepath.Join(dir, "nested.git")
+	for _, path := range []string{repoPath + "/refs/heads", poolPath + "/refs/heads", poolPath + "/objects/info", nestedPath + "/refs/heads", nestedPath + "/objects"} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The pool borrows from another repository in turn
+	if err := ioutil.WriteFile(filepath.Join(poolPath, "objects/info/alternates"), []byte(nestedPath+"/objects\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"GIT_ALTERNATE_OBJECT_DIRECTORIES": poolPath + "/objects"}
+
+	for _, refsPath := range []string{poolPath, nestedPath} {
+		before, err := refsFingerprint(repoPath, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(refsPath, "refs/heads/master"), []byte(someID+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		after, err := refsFingerprint(repoPath, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before == after {
+			t.Fatalf("expected fingerprint to change when a ref of %s is created", refsPath)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package git
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
 	"path"
+	"strings"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
@@ -13,13 +15,32 @@ import (
 )
 
 func GetInfoRefsHandler(a *api.API, cfg *config.Config) http.Handler {
-	return repoPreAuthorizeHandler(a, func(rw http.ResponseWriter, r *http.Request, apiResponse *api.Response) {
-		if apiResponse.GitalySocketPath == "" {
-			handleGetInfoRefs(rw, r, apiResponse)
+	smartHandler := repoPreAuthorizeHandler(a, func(rw http.ResponseWriter, r *http.Request, apiResponse *api.Response) {
+		if apiResponse.GitalySocketPath == "" || !gitalyCanServeInfoRefs(apiResponse) {
+			handleGetInfoRefs(rw, r, apiResponse, cfg)
 		} else {
 			handleGetInfoRefsWithGitaly(rw, r, apiResponse, gitaly.NewClient(apiResponse.GitalySocketPath, cfg))
 		}
 	})
+	if !cfg.GitDumbHTTP {
+		return smartHandler
+	}
+
+	dumbHandler := DumbHTTPHandler(a)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if getService(r) == "" {
+			dumbHandler.ServeHTTP(w, r)
+		} else {
+			smartHandler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// gitalyCanServeInfoRefs reports whether Gitaly gives the same
+// advertisement as we would. Gitaly does not know the ref filters and the
+// Git environment that GitLab gives us, and would advertise hidden refs.
+func gitalyCanServeInfoRefs(a *api.Response) bool {
+	return newRefFilter(a) == nil && len(a.GitEnv) == 0
 }
 
 func handleGetInfoRefsWithGitaly(rw http.ResponseWriter, r *http.Request, a *api.Response, gitalyClient *gitaly.Client) {
@@ -33,7 +54,7 @@ func handleGetInfoRefsWithGitaly(rw http.ResponseWriter, r *http.Request, a *api
 	gitalyClient.Proxy.ServeHTTP(rw, &req)
 }
 
-func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response) {
+func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response, cfg *config.Config) {
 	w := NewGitHttpResponseWriter(rw)
 	// Log 0 bytes in because we ignore the request body (and there usually is none anyway).
 	defer w.Log(r, 0)
@@ -45,28 +66,49 @@ func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response)
 		return
 	}
 
-	cmd, stdin, stdout, err := setupGitCommand(rpc, a, "--advertise-refs")
+	env, err := gitEnv(a.GitEnv)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("handleGetInfoRefs: %v", err))
+		return
+	}
+
+	cacheKey := advertisementKey{repoPath: a.RepoPath, service: rpc, env: strings.Join(env, "\x00")}
+	var fingerprint string
+	if cfg.InfoRefsCacheSize > 0 {
+		// Take the fingerprint before running Git: if the refs change while
+		// Git runs we store a newer advertisement under an older fingerprint,
+		// which only makes the next lookup miss.
+		if fingerprint, err = refsFingerprint(a.RepoPath, a.GitEnv); err != nil {
+			if err != errTooManyLooseRefs {
+				helper.LogError(r, fmt.Errorf("handleGetInfoRefs: refsFingerprint: %v", err))
+			}
+			fingerprint = ""
+		} else if data, ok := infoRefsCache.get(cacheKey, fingerprint); ok {
+			if err := writeInfoRefsResponse(w, rpc, bytes.NewReader(data), a); err != nil {
+				helper.LogError(r, &copyError{fmt.Errorf("handleGetInfoRefs: copy cached advertisement: %v", err)})
+			}
+			return
+		}
+	}
+
+	cmd, stdin, stdout, err := setupGitCommand(rpc, a, nil, nil, "--advertise-refs")
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("handleGetInfoRefs: setupGitCommand: %v", err))
 		return
 	}
 	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
 	stdin.Close()                         // Not needed for this request
+	defer helper.WatchProcessGroup(r.Context(), subCommand(rpc), cmd)()
 	defer stdout.Close()
 
-	// Start writing the response
-	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
-	w.Header().Set("Cache-Control", "no-cache")
-	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
-	if err := pktLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
-		helper.LogError(r, fmt.Errorf("handleGetInfoRefs: pktLine: %v", err))
-		return
+	var advertisement io.Reader = stdout
+	var cacheBuffer *bytes.Buffer
+	if fingerprint != "" {
+		cacheBuffer = &bytes.Buffer{}
+		advertisement = io.TeeReader(stdout, cacheBuffer)
 	}
-	if err := pktFlush(w); err != nil {
-		helper.LogError(r, fmt.Errorf("handleGetInfoRefs: pktFlush: %v", err))
-		return
-	}
-	if _, err := io.Copy(w, stdout); err != nil {
+
+	if err := writeInfoRefsResponse(w, rpc, advertisement, a); err != nil {
 		helper.LogError(
 			r,
 			&copyError{fmt.Errorf("handleGetInfoRefs: copy output of %v: %v", cmd.Args, err)},
@@ -74,7 +116,30 @@ func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response)
 		return
 	}
 	if err := cmd.Wait(); err != nil {
-		helper.LogError(r, fmt.Errorf("handleGetInfoRefs: wait for %v: %v", cmd.Args, err))
+		helper.LogError(r, helper.NewProcessError(cmd, fmt.Errorf("handleGetInfoRefs: wait for %v: %v", cmd.Args, err)))
 		return
 	}
+
+	if cacheBuffer != nil {
+		infoRefsCache.put(cacheKey, fingerprint, cacheBuffer.Bytes(), cfg.InfoRefsCacheSize)
+	}
+}
+
+func writeInfoRefsResponse(w http.ResponseWriter, rpc string, advertisement io.Reader, a *api.Response) error {
+	// Start writing the response
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
+	if err := pktLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
+		return fmt.Errorf("pktLine: %v", err)
+	}
+	if err := pktFlush(w); err != nil {
+		return fmt.Errorf("pktFlush: %v", err)
+	}
+
+	if filter := newRefFilter(a); filter != nil {
+		return filter.copy(w, advertisement)
+	}
+	_, err := io.Copy(w, advertisement)
+	return err
 }
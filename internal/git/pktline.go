@@ -1,7 +1,6 @@
 package git
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -13,21 +12,67 @@ func pktLine(w io.Writer, s string) error {
 	return err
 }
 
+// pktError writes an "ERR" packet. Git clients abort and show msg to the
+// user when they receive one.
+func pktError(w io.Writer, msg string) error {
+	return pktLine(w, fmt.Sprintf("ERR %s\n", msg))
+}
+
 func pktFlush(w io.Writer) error {
 	_, err := fmt.Fprint(w, "0000")
 	return err
 }
 
-func scanDeepen(body io.Reader) bool {
-	scanner := bufio.NewScanner(body)
-	scanner.Split(pktLineSplitter)
-	for scanner.Scan() {
-		if bytes.HasPrefix(scanner.Bytes(), []byte("deepen")) && scanner.Err() == nil {
-			return true
+// readPktLine reads a single packet line from r and returns its payload
+// without the length prefix. A flush packet ("0000") yields a nil payload.
+// It never reads past the end of the packet.
+func readPktLine(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	pktLength, err := strconv.ParseInt(string(prefix), 16, 0)
+	if err != nil {
+		return nil, fmt.Errorf("readPktLine: decode length: %v", err)
+	}
+
+	if pktLength == 0 {
+		return nil, nil
+	}
+
+	if pktLength < 4 {
+		return nil, fmt.Errorf("readPktLine: invalid length: %d", pktLength)
+	}
+
+	payload := make([]byte, pktLength-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("readPktLine: read payload: %v", err)
+	}
+
+	return payload, nil
+}
+
+// pktSideband writes data to w as one or more side-band packets on the given
+// band. Each packet carries at most maxData bytes of data.
+func pktSideband(w io.Writer, band byte, data []byte, maxData int) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxData {
+			n = maxData
+		}
+
+		if _, err := fmt.Fprintf(w, "%04x%c", n+5, band); err != nil {
+			return err
 		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+
+		data = data[n:]
 	}
 
-	return false
+	return nil
 }
 
 func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -57,6 +102,12 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 		return 0, nil, fmt.Errorf("pktLineSplitter: invalid length: %d", pktLength)
 	}
 
+	if pktLength < 4 {
+		// special case: protocol v2 "0001" delimiter and "0002" response-end
+		// packets: return empty token
+		return 4, data[:0], nil
+	}
+
 	if len(data) < pktLength {
 		if atEOF {
 			return 0, nil, fmt.Errorf("pktLineSplitter: less than %d bytes in input %q", pktLength, data)
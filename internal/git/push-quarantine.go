@@ -0,0 +1,198 @@
+/*
+In this file we receive the objects of a push into a quarantine object
+directory, where we can inspect them before 'git receive-pack' runs
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// pushQuarantine is an object directory for the objects of a push that we
+// have not accepted yet. Git reads existing objects from the object
+// directory of the repository. The objects never leave the quarantine:
+// once we accept them, 'git receive-pack' gets the pack of the client
+// again, so that its own quarantine, hooks and limits apply as usual.
+type pushQuarantine struct {
+	dir      string
+	env      []string // Git environment with new objects going to dir
+	packCopy *os.File // The pack as the client sent it
+}
+
+func newPushQuarantine(a *api.Response) (*pushQuarantine, error) {
+	objects := a.GitEnv["GIT_OBJECT_DIRECTORY"]
+	if objects == "" {
+		objects = filepath.Join(a.RepoPath, "objects")
+	}
+
+	// Git itself uses objects/incoming-* for its quarantine directories
+	dir, err := ioutil.TempDir(objects, "incoming-workhorse-")
+	if err != nil {
+		return nil, fmt.Errorf("create quarantine directory: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "pack"), 0700); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("create quarantine pack directory: %v", err)
+	}
+
+	env := map[string]string{}
+	for k, v := range a.GitEnv {
+		env[k] = v
+	}
+	alternates := objects
+	if existing := env["GIT_ALTERNATE_OBJECT_DIRECTORIES"]; existing != "" {
+		alternates = strings.Join([]string{objects, existing}, string(filepath.ListSeparator))
+	}
+	env["GIT_OBJECT_DIRECTORY"] = dir
+	env["GIT_ALTERNATE_OBJECT_DIRECTORIES"] = alternates
+
+	q := &pushQuarantine{dir: dir}
+	if q.env, err = gitEnv(env); err != nil {
+		q.remove()
+		return nil, err
+	}
+	return q, nil
+}
+
+// receive indexes the pack data from pack into the quarantine, and keeps a
+// copy of it for pack. Like 'git receive-pack' it checks the objects if
+// receive.fsckObjects or transfer.fsckObjects is set, and refuses packs
+// larger than receive.maxInputSize. A *pushSizeError from pack is returned
+// as it is.
+func (q *pushQuarantine) receive(ctx context.Context, a *api.Response, pack io.Reader) error {
+	packCopy, err := os.Create(filepath.Join(q.dir, "push.pack"))
+	if err != nil {
+		return fmt.Errorf("create quarantine pack copy: %v", err)
+	}
+	q.packCopy = packCopy
+
+	buffered := bufio.NewReader(pack)
+	if _, err := buffered.Peek(1); err == io.EOF {
+		// Nothing to index, e.g. the client only creates refs for existing
+		// commits
+		return nil
+	}
+
+	args := []string{"--git-dir=" + a.RepoPath, "index-pack", "--stdin", "--fix-thin"}
+	strict, err := q.fsckObjects(ctx, a)
+	if err != nil {
+		return err
+	}
+	if strict {
+		args = append(args, "--strict")
+	}
+	maxInputSize, ok, err := gitConfigInt(ctx, a, q.env, "receive.maxInputSize")
+	if err != nil {
+		return err
+	}
+	if ok && maxInputSize > 0 {
+		args = append(args, fmt.Sprintf("--max-input-size=%d", maxInputSize))
+	}
+
+	cmd := gitCommand(a.GL_ID, q.env, "git", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("index-pack stdin: %v", err)
+	}
+	defer stdin.Close()
+
+	helper.LimitProcess("receive-pack", cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %v: %v", cmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(ctx, "receive-pack", cmd)()
+
+	if _, err := io.Copy(stdin, io.TeeReader(buffered, q.packCopy)); err != nil {
+		if sizeErr, ok := err.(*pushSizeError); ok {
+			return sizeErr
+		}
+		return fmt.Errorf("write to %v: %v", cmd.Args, err)
+	}
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		return helper.NewProcessError(cmd, fmt.Errorf("wait for %v: %v", cmd.Args, err))
+	}
+	return nil
+}
+
+func (q *pushQuarantine) fsckObjects(ctx context.Context, a *api.Response) (bool, error) {
+	for _, key := range []string{"receive.fsckObjects", "transfer.fsckObjects"} {
+		value, ok, err := gitConfigBool(ctx, a, q.env, key)
+		if err != nil || ok {
+			return value, err
+		}
+	}
+	return false, nil
+}
+
+// gitConfigBool reads a boolean from the Git configuration of the
+// repository of a. It returns ok=false if key is not set.
+func gitConfigBool(ctx context.Context, a *api.Response, env []string, key string) (value bool, ok bool, err error) {
+	output, ok, err := gitConfig(ctx, a, env, "--bool", key)
+	return output == "true", ok, err
+}
+
+// gitConfigInt reads an integer, which may have a unit suffix like "k" or
+// "m", from the Git configuration of the repository of a. It returns
+// ok=false if key is not set.
+func gitConfigInt(ctx context.Context, a *api.Response, env []string, key string) (value int64, ok bool, err error) {
+	output, ok, err := gitConfig(ctx, a, env, "--int", key)
+	if err != nil || !ok {
+		return 0, ok, err
+	}
+	if value, err = strconv.ParseInt(output, 10, 64); err != nil {
+		return 0, false, fmt.Errorf("git config %s: %v", key, err)
+	}
+	return value, true, nil
+}
+
+func gitConfig(ctx context.Context, a *api.Response, env []string, typeFlag string, key string) (value string, ok bool, err error) {
+	cmd := gitCommand(a.GL_ID, env, "git", "--git-dir="+a.RepoPath, "config", typeFlag, "--get", key)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	helper.LimitProcess("receive-pack", cmd)
+	if err := cmd.Start(); err != nil {
+		return "", false, fmt.Errorf("start %v: %v", cmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(ctx, "receive-pack", cmd)()
+
+	if err := cmd.Wait(); err != nil {
+		if status, exited := helper.ExitStatus(err); exited && status == 1 {
+			return "", false, nil
+		}
+		return "", false, helper.NewProcessError(cmd, fmt.Errorf("wait for %v: %v", cmd.Args, err))
+	}
+	return strings.TrimSpace(output.String()), true, nil
+}
+
+// pack returns the pack data that the client sent, to pass on to 'git
+// receive-pack'
+func (q *pushQuarantine) pack() (io.Reader, error) {
+	if _, err := q.packCopy.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("rewind quarantine pack copy: %v", err)
+	}
+	return q.packCopy, nil
+}
+
+func (q *pushQuarantine) remove() {
+	if q.packCopy != nil {
+		q.packCopy.Close()
+	}
+	os.RemoveAll(q.dir)
+}
@@ -0,0 +1,221 @@
+/*
+In this file we let an external scanner inspect the content of a push
+before Git updates any refs
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// pushScanner sends the blobs that a push adds to a scanning hook, which is
+// either an executable or an HTTP endpoint. The hook gets a
+// pushScanRequest as JSON, on stdin or as the POST body, and answers with a
+// pushScanResponse.
+type pushScanner struct {
+	hook    string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// defaultPushScanTimeout applies if no push scan timeout is configured. We
+// must not let a hook that does not answer hold up pushes forever.
+const defaultPushScanTimeout = time.Minute
+
+type pushScanRequest struct {
+	RepoPath string `json:"repo_path"`
+	// QuarantinePath is the object directory that holds the new objects.
+	// Use it as GIT_OBJECT_DIRECTORY, with the object directory of the
+	// repository in GIT_ALTERNATE_OBJECT_DIRECTORIES, to read the blobs.
+	QuarantinePath string        `json:"quarantine_path"`
+	Refs           []pushScanRef `json:"refs"`
+}
+
+type pushScanRef struct {
+	Ref   string   `json:"ref"`
+	OldID string   `json:"old_id"`
+	NewID string   `json:"new_id"`
+	Blobs []string `json:"blobs"`
+}
+
+type pushScanResponse struct {
+	// Rejections maps refs to the reason their update is rejected. The push
+	// is accepted if it is empty.
+	Rejections map[string]string `json:"rejections"`
+}
+
+func newPushScanner(cfg *config.Config) *pushScanner {
+	if cfg.PushScanHook == "" {
+		return nil
+	}
+	timeout := cfg.PushScanTimeout
+	if timeout <= 0 {
+		timeout = defaultPushScanTimeout
+	}
+	return &pushScanner{hook: cfg.PushScanHook, timeout: timeout, client: &http.Client{Timeout: timeout}}
+}
+
+// scan asks the hook about the blobs that push adds. The objects of push
+// must be in the quarantine q. It returns the rejected refs.
+func (s *pushScanner) scan(ctx context.Context, a *api.Response, push *receivePackRequest, q *pushQuarantine) (rejections map[string]string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	req := &pushScanRequest{RepoPath: a.RepoPath, QuarantinePath: q.dir}
+	for _, u := range push.Commands {
+		if u.isDelete() {
+			continue
+		}
+
+		blobs, err := newBlobs(ctx, a, q.env, u.NewID)
+		if err != nil {
+			return nil, err
+		}
+		req.Refs = append(req.Refs, pushScanRef{Ref: u.Ref, OldID: u.OldID, NewID: u.NewID, Blobs: blobs})
+	}
+
+	resp, err := s.call(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The reasons end up in pkt-lines of the report-status, which must be
+	// single lines. Rejections of refs that are not in the push are
+	// ignored, or they would fail the whole push.
+	rejections = map[string]string{}
+	for _, ref := range req.Refs {
+		reason, ok := resp.Rejections[ref.Ref]
+		if !ok {
+			continue
+		}
+		reason = strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ").Replace(reason))
+		if reason == "" {
+			reason = "rejected by content scan"
+		}
+		rejections[ref.Ref] = reason
+	}
+	return rejections, nil
+}
+
+// newBlobs lists the blobs reachable from newID but not from any existing
+// ref
+func newBlobs(ctx context.Context, a *api.Response, env []string, newID string) ([]string, error) {
+	revList := gitCommand(a.GL_ID, env, "git", "--git-dir="+a.RepoPath, "rev-list", "--objects", newID, "--not", "--all")
+	objects := &bytes.Buffer{}
+	revList.Stdout = objects
+	if err := runScanCommand(ctx, revList); err != nil {
+		return nil, err
+	}
+
+	ids := &bytes.Buffer{}
+	scanner := bufio.NewScanner(objects)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			fmt.Fprintln(ids, fields[0])
+		}
+	}
+	if ids.Len() == 0 {
+		return nil, nil
+	}
+
+	catFile := gitCommand(a.GL_ID, env, "git", "--git-dir="+a.RepoPath, "cat-file", "--batch-check=%(objecttype) %(objectname)")
+	catFile.Stdin = ids
+	types := &bytes.Buffer{}
+	catFile.Stdout = types
+	if err := runScanCommand(ctx, catFile); err != nil {
+		return nil, err
+	}
+
+	var blobs []string
+	scanner = bufio.NewScanner(types)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "blob" {
+			blobs = append(blobs, fields[1])
+		}
+	}
+	return blobs, nil
+}
+
+func runScanCommand(ctx context.Context, cmd *exec.Cmd) error {
+	helper.LimitProcess("push-scan", cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %v: %v", cmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(cmd)
+	defer helper.WatchProcessGroup(ctx, "push-scan", cmd)()
+
+	if err := cmd.Wait(); err != nil {
+		return helper.NewProcessError(cmd, fmt.Errorf("wait for %v: %v", cmd.Args, err))
+	}
+	return nil
+}
+
+func (s *pushScanner) call(ctx context.Context, req *pushScanRequest) (*pushScanResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal push scan request: %v", err)
+	}
+
+	var output []byte
+	if strings.HasPrefix(s.hook, "http://") || strings.HasPrefix(s.hook, "https://") {
+		output, err = s.post(ctx, body)
+	} else {
+		output, err = s.exec(ctx, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pushScanResponse{}
+	if err := json.Unmarshal(output, resp); err != nil {
+		return nil, fmt.Errorf("push scan hook %s: decode response: %v", s.hook, err)
+	}
+	return resp, nil
+}
+
+func (s *pushScanner) post(ctx context.Context, body []byte) ([]byte, error) {
+	httpReq, err := http.NewRequest("POST", s.hook, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("push scan hook %s: %v", s.hook, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := s.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("push scan hook %s: %v", s.hook, err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != 200 {
+		return nil, fmt.Errorf("push scan hook %s: %s", s.hook, httpResp.Status)
+	}
+	return ioutil.ReadAll(httpResp.Body)
+}
+
+func (s *pushScanner) exec(ctx context.Context, body []byte) ([]byte, error) {
+	cmd := exec.Command(s.hook)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stderr = helper.NewStderrBuffer()
+	cmd.Stdin = bytes.NewReader(body)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	if err := runScanCommand(ctx, cmd); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
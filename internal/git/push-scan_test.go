@@ -0,0 +1,231 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func runGit(t *testing.T, dir string, stdin []byte, args ...string) []byte {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return output
+}
+
+// setupPush creates a client repository with one commit that the bare
+// server repository does not have, and returns a pack with that commit.
+func setupPush(t *testing.T, dir string) (server string, commitID string, blobID string, pack []byte) {
+	client := filepath.Join(dir, "client")
+	server = filepath.Join(dir, "server.git")
+	runGit(t, dir, nil, "init", "-q", client)
+	runGit(t, dir, nil, "init", "-q", "--bare", server)
+	if err := ioutil.WriteFile(filepath.Join(client, "secret.txt"), []byte("hunter2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, client, nil, "add", "secret.txt")
+	runGit(t, client, nil, "commit", "-q", "-m", "add secret")
+	commitID = strings.TrimSpace(string(runGit(t, client, nil, "rev-parse", "HEAD")))
+	blobID = strings.TrimSpace(string(runGit(t, client, nil, "rev-parse", "HEAD:secret.txt")))
+	pack = runGit(t, client, []byte(commitID+"\n"), "pack-objects", "--revs", "--stdout", "-q")
+	return server, commitID, blobID, pack
+}
+
+func TestPushScanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, commitID, blobID, pack := setupPush(t, dir)
+
+	var scanRequest pushScanRequest
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&scanRequest); err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(&pushScanResponse{Rejections: map[string]string{
+			"refs/heads/master": "contains\r\na secret\n",
+			"refs/heads/other":  "not in the push",
+		}})
+	}))
+	defer hook.Close()
+
+	a := &api.Response{RepoPath: server}
+	q, err := newPushQuarantine(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.remove()
+	if err := q.receive(context.Background(), a, bytes.NewReader(pack)); err != nil {
+		t.Fatal(err)
+	}
+
+	push := &receivePackRequest{Commands: []refUpdate{{OldID: nullObjectID, NewID: commitID, Ref: "refs/heads/master"}}}
+	scanner := newPushScanner(&config.Config{PushScanHook: hook.URL})
+	rejections, err := scanner.scan(context.Background(), a, push, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if scanRequest.QuarantinePath != q.dir {
+		t.Fatalf("expected quarantine path %q, got %q", q.dir, scanRequest.QuarantinePath)
+	}
+	if len(scanRequest.Refs) != 1 || len(scanRequest.Refs[0].Blobs) != 1 || scanRequest.Refs[0].Blobs[0] != blobID {
+		t.Fatalf("expected scan request for blob %s, got %+v", blobID, scanRequest)
+	}
+	if len(rejections) != 1 || rejections["refs/heads/master"] != "contains  a secret" {
+		t.Fatalf("unexpected rejections %v", rejections)
+	}
+}
+
+func TestHandleReceivePackWithPushScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, commitID, _, pack := setupPush(t, dir)
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&pushScanResponse{})
+	}))
+	defer hook.Close()
+
+	body := &bytes.Buffer{}
+	pktLine(body, nullObjectID+" "+commitID+" refs/heads/master\x00report-status\n")
+	pktFlush(body)
+	body.Write(pack)
+
+	req, err := http.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	scanner := newPushScanner(&config.Config{PushScanHook: hook.URL})
+	if _, err := handleReceivePack(NewGitHttpResponseWriter(rr), req, &api.Response{RepoPath: server}, scanner); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "ok refs/heads/master\n"; !strings.Contains(rr.Body.String(), expected) {
+		t.Fatalf("expected response to contain %q, got %q", expected, rr.Body.String())
+	}
+	if head := strings.TrimSpace(string(runGit(t, server, nil, "rev-parse", "refs/heads/master"))); head != commitID {
+		t.Fatalf("expected master at %s, got %s", commitID, head)
+	}
+	runGit(t, server, nil, "fsck", "--no-dangling")
+
+	quarantines, err := filepath.Glob(filepath.Join(server, "objects/incoming-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantines) > 0 {
+		t.Fatalf("expected quarantine directories to be removed, got %v", quarantines)
+	}
+}
+
+func TestHandleReceivePackWithPushScanDeclinedByHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, commitID, _, pack := setupPush(t, dir)
+	if err := ioutil.WriteFile(filepath.Join(server, "hooks/pre-receive"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&pushScanResponse{})
+	}))
+	defer hook.Close()
+
+	body := &bytes.Buffer{}
+	pktLine(body, nullObjectID+" "+commitID+" refs/heads/master\x00report-status\n")
+	pktFlush(body)
+	body.Write(pack)
+
+	req, err := http.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	scanner := newPushScanner(&config.Config{PushScanHook: hook.URL})
+	handleReceivePack(NewGitHttpResponseWriter(rr), req, &api.Response{RepoPath: server}, scanner)
+
+	if expected := "ng refs/heads/master pre-receive hook declined\n"; !strings.Contains(rr.Body.String(), expected) {
+		t.Fatalf("expected response to contain %q, got %q", expected, rr.Body.String())
+	}
+	cmd := exec.Command("git", "--git-dir="+server, "cat-file", "-e", commitID)
+	if err := cmd.Run(); err == nil {
+		t.Fatal("expected the objects of a declined push to stay out of the repository")
+	}
+}
+
+func TestPushQuarantineMaxInputSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, _, _, pack := setupPush(t, dir)
+	runGit(t, server, nil, "config", "receive.maxInputSize", "10")
+
+	a := &api.Response{RepoPath: server}
+	q, err := newPushQuarantine(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.remove()
+	if err := q.receive(context.Background(), a, bytes.NewReader(pack)); err == nil {
+		t.Fatal("expected index-pack to refuse a pack larger than receive.maxInputSize")
+	}
+}
+
+func TestPushScannerExecCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hook := filepath.Join(dir, "hook")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\nsleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	scanner := newPushScanner(&config.Config{PushScanHook: hook})
+	if _, err := scanner.exec(ctx, []byte("{}")); err == nil {
+		t.Fatal("expected error from cancelled hook")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("hook was not stopped when the request was cancelled, took %v", elapsed)
+	}
+}
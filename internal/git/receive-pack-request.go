@@ -0,0 +1,229 @@
+/*
+In this file we parse the ref update commands at the start of a
+'git-receive-pack' request and write 'report-status' responses
+*/
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// The command section holds one pkt-line per ref update, about 100
+	// bytes each. With a limit of 10MB a client can update over 100,000
+	// refs in a single push.
+	maxReceivePackCommandsSize = 10 * 1024 * 1024
+
+	// Push options end up in the environment of the Git hooks twice, as
+	// GIT_PUSH_OPTION_* and GL_PUSH_OPTION_*, so they must stay well below
+	// the limits of execve(2).
+	maxPushOptions     = 100
+	maxPushOptionsSize = 64 * 1024
+
+	sidebandDataLimit    = 995   // 1000 byte packets minus length prefix and band byte
+	sideband64kDataLimit = 65515 // 65520 byte packets minus length prefix and band byte
+
+	sidebandData     = 1
+	sidebandProgress = 2
+	sidebandError    = 3
+
+	// Git uses the all-zeroes object ID for the old value of a ref that is
+	// being created and the new value of a ref that is being deleted.
+	nullObjectID = "0000000000000000000000000000000000000000"
+)
+
+type refUpdate struct {
+	OldID string
+	NewID string
+	Ref   string
+}
+
+func (u refUpdate) isCreate() bool { return u.OldID == nullObjectID }
+func (u refUpdate) isDelete() bool { return u.NewID == nullObjectID }
+
+type receivePackRequest struct {
+	Commands     []refUpdate
+	Capabilities []string
+	// PushOptions are the 'git push -o' values, if the client sent any
+	PushOptions []string
+
+	// raw holds the bytes consumed while parsing, so that they can be
+	// replayed to 'git receive-pack' ahead of the pack data.
+	raw bytes.Buffer
+}
+
+// parseReceivePackRequest consumes the command section of a receive-pack
+// request from body, followed by the push options section if the client
+// asked for it. Everything after that, usually the pack data, is left
+// unread in body.
+func parseReceivePackRequest(body io.Reader) (*receivePackRequest, error) {
+	req := &receivePackRequest{}
+	r := io.TeeReader(body, &req.raw)
+
+	for {
+		if req.raw.Len() > maxReceivePackCommandsSize {
+			return nil, fmt.Errorf("parseReceivePackRequest: command section exceeds %d bytes", maxReceivePackCommandsSize)
+		}
+
+		line, err := readPktLine(r)
+		if err == io.EOF && req.raw.Len() == 0 {
+			// An empty request body is nothing to parse
+			return req, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parseReceivePackRequest: %v", err)
+		}
+		if line == nil {
+			break
+		}
+
+		if len(req.Commands) == 0 {
+			if i := bytes.IndexByte(line, 0); i >= 0 {
+				req.Capabilities = strings.Fields(string(line[i+1:]))
+				line = line[:i]
+			}
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("parseReceivePackRequest: invalid command %q", line)
+		}
+		req.Commands = append(req.Commands, refUpdate{OldID: fields[0], NewID: fields[1], Ref: fields[2]})
+	}
+
+	if !req.hasCapability("push-options") {
+		return req, nil
+	}
+
+	for {
+		if req.raw.Len() > maxReceivePackCommandsSize {
+			return nil, fmt.Errorf("parseReceivePackRequest: push options exceed %d bytes", maxReceivePackCommandsSize)
+		}
+
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, fmt.Errorf("parseReceivePackRequest: push options: %v", err)
+		}
+		if line == nil {
+			break
+		}
+
+		option := strings.TrimSuffix(string(line), "\n")
+		if strings.ContainsAny(option, "\x00\n") {
+			return nil, fmt.Errorf("parseReceivePackRequest: invalid push option %q", option)
+		}
+		req.PushOptions = append(req.PushOptions, option)
+	}
+
+	return req, nil
+}
+
+// checkPushOptions returns a message for the client if req has more push
+// options than we can pass on, or an empty string if it does not.
+func (req *receivePackRequest) checkPushOptions() string {
+	if len(req.PushOptions) > maxPushOptions {
+		return fmt.Sprintf("too many push options: %d, maximum is %d", len(req.PushOptions), maxPushOptions)
+	}
+
+	size := 0
+	for _, option := range req.PushOptions {
+		size += len(option)
+	}
+	if size > maxPushOptionsSize {
+		return fmt.Sprintf("push options are too large: %d bytes, maximum is %d", size, maxPushOptionsSize)
+	}
+
+	return ""
+}
+
+// pushOptionsEnv passes the push options on to the GitLab hooks that run
+// under 'git receive-pack'. Git itself only sets GIT_PUSH_OPTION_* for the
+// pre-receive and post-receive hooks.
+func (req *receivePackRequest) pushOptionsEnv() []string {
+	if len(req.PushOptions) == 0 {
+		return nil
+	}
+
+	env := []string{fmt.Sprintf("GL_PUSH_OPTION_COUNT=%d", len(req.PushOptions))}
+	for i, option := range req.PushOptions {
+		env = append(env, fmt.Sprintf("GL_PUSH_OPTION_%d=%s", i, option))
+	}
+	return env
+}
+
+// hasNewObjects tells whether the client sends pack data, which it does
+// unless it only deletes refs
+func (req *receivePackRequest) hasNewObjects() bool {
+	for _, u := range req.Commands {
+		if !u.isDelete() {
+			return true
+		}
+	}
+	return false
+}
+
+func (req *receivePackRequest) hasCapability(name string) bool {
+	for _, c := range req.Capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sidebandMaxData returns the maximum number of data bytes per side-band
+// packet the client negotiated, or zero if side-band is not in use.
+func (req *receivePackRequest) sidebandMaxData() int {
+	switch {
+	case req.hasCapability("side-band-64k"):
+		return sideband64kDataLimit
+	case req.hasCapability("side-band"):
+		return sidebandDataLimit
+	}
+	return 0
+}
+
+// writeRejection tells the client that none of its ref updates were
+// applied. Refs listed in reasons are reported with their own reason, all
+// others with defaultReason.
+func (req *receivePackRequest) writeRejection(w io.Writer, unpackStatus string, reasons map[string]string, defaultReason string) error {
+	maxData := req.sidebandMaxData()
+
+	if maxData > 0 && unpackStatus != "ok" {
+		msg := fmt.Sprintf("GitLab: %s\n", unpackStatus)
+		if err := pktSideband(w, sidebandProgress, []byte(msg), maxData); err != nil {
+			return err
+		}
+	}
+
+	if req.hasCapability("report-status") {
+		report := &bytes.Buffer{}
+		pktLine(report, fmt.Sprintf("unpack %s\n", unpackStatus))
+		for _, cmd := range req.Commands {
+			reason, ok := reasons[cmd.Ref]
+			if !ok {
+				reason = defaultReason
+			}
+			pktLine(report, fmt.Sprintf("ng %s %s\n", cmd.Ref, reason))
+		}
+		pktFlush(report)
+
+		if maxData > 0 {
+			if err := pktSideband(w, sidebandData, report.Bytes(), maxData); err != nil {
+				return err
+			}
+		} else if _, err := w.Write(report.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if maxData > 0 {
+		return pktFlush(w)
+	}
+
+	return nil
+}
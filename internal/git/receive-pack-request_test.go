@@ -0,0 +1,154 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+const someID = "1234567890123456789012345678901234567890"
+
+func TestParseReceivePackRequest(t *testing.T) {
+	input := &bytes.Buffer{}
+	pktLine(input, nullObjectID+" "+someID+" refs/heads/master\x00report-status side-band-64k agent=git/2.11.0\n")
+	pktLine(input, someID+" "+nullObjectID+" refs/heads/feature\n")
+	pktFlush(input)
+	expectedRaw := input.String()
+	input.WriteString("PACK rest of the request")
+
+	body := bufio.NewReader(input)
+	push, err := parseReceivePackRequest(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(push.Commands) != 2 {
+		t.Fatalf("expected 2 commands, got %d", len(push.Commands))
+	}
+	if cmd := push.Commands[1]; cmd.OldID != someID || cmd.NewID != nullObjectID || cmd.Ref != "refs/heads/feature" {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+	if !push.hasCapability("report-status") || push.sidebandMaxData() != sideband64kDataLimit {
+		t.Fatalf("unexpected capabilities %v", push.Capabilities)
+	}
+	if push.raw.String() != expectedRaw {
+		t.Fatalf("expected raw %q, got %q", expectedRaw, push.raw.String())
+	}
+
+	rest, _ := ioutil.ReadAll(body)
+	if string(rest) != "PACK rest of the request" {
+		t.Fatalf("parser consumed too much: remaining %q", rest)
+	}
+}
+
+func TestParseInvalidReceivePackRequest(t *testing.T) {
+	for _, input := range []string{
+		"0010not a command0000",
+		"zzzz",
+		"0030" + nullObjectID,
+	} {
+		if _, err := parseReceivePackRequest(strings.NewReader(input)); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
+
+func TestWriteRejection(t *testing.T) {
+	push := &receivePackRequest{
+		Commands: []refUpdate{
+			{nullObjectID, someID, "refs/heads/master"},
+			{nullObjectID, someID, "refs/heads/other"},
+		},
+		Capabilities: []string{"report-status"},
+	}
+
+	out := &bytes.Buffer{}
+	if err := push.writeRejection(out, "too big", map[string]string{"refs/heads/other": "bad ref"}, "rejected"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "0013unpack too big\n" +
+		"0022ng refs/heads/master rejected\n" +
+		"0020ng refs/heads/other bad ref\n" +
+		"0000"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestCheckRefRules(t *testing.T) {
+	rules := []api.RefRule{
+		{Ref: "refs/keep-around/", Deny: true},
+		{Ref: "refs/heads/master", DenyDelete: true, DenyForcePush: true},
+	}
+
+	for _, tc := range []struct {
+		cmd           refUpdate
+		denied        bool
+		denyForcePush bool
+	}{
+		{refUpdate{nullObjectID, someID, "refs/keep-around/" + someID}, true, false},
+		{refUpdate{someID, nullObjectID, "refs/heads/master"}, true, false},
+		{refUpdate{someID, someID, "refs/heads/master"}, false, true},
+		{refUpdate{nullObjectID, someID, "refs/heads/master"}, false, false},
+		{refUpdate{someID, nullObjectID, "refs/heads/master-2"}, false, false},
+	} {
+		push := &receivePackRequest{Commands: []refUpdate{tc.cmd}}
+		reasons, forcePushChecks := checkRefRules(push, rules)
+
+		if _, denied := reasons[tc.cmd.Ref]; denied != tc.denied {
+			t.Errorf("%+v: expected denied=%v, got reasons %v", tc.cmd, tc.denied, reasons)
+		}
+		if denyForcePush := len(forcePushChecks) > 0; denyForcePush != tc.denyForcePush {
+			t.Errorf("%+v: expected denyForcePush=%v", tc.cmd, tc.denyForcePush)
+		}
+	}
+}
+
+func TestParseReceivePackRequestWithPushOptions(t *testing.T) {
+	input := &bytes.Buffer{}
+	pktLine(input, nullObjectID+" "+someID+" refs/heads/master\x00report-status push-options\n")
+	pktFlush(input)
+	pktLine(input, "ci.skip\n")
+	pktLine(input, "merge_request.target=master\n")
+	pktFlush(input)
+	expectedRaw := input.String()
+	input.WriteString("PACK")
+
+	body := bufio.NewReader(input)
+	push, err := parseReceivePackRequest(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if push.raw.String() != expectedRaw {
+		t.Fatalf("expected raw %q, got %q", expectedRaw, push.raw.String())
+	}
+
+	expectedEnv := []string{"GL_PUSH_OPTION_COUNT=2", "GL_PUSH_OPTION_0=ci.skip", "GL_PUSH_OPTION_1=merge_request.target=master"}
+	if env := push.pushOptionsEnv(); !reflect.DeepEqual(env, expectedEnv) {
+		t.Fatalf("expected %v, got %v", expectedEnv, env)
+	}
+}
+
+func TestCheckPushOptions(t *testing.T) {
+	for _, tc := range []struct {
+		options []string
+		allowed bool
+	}{
+		{nil, true},
+		{[]string{"ci.skip"}, true},
+		{make([]string, maxPushOptions+1), false},
+		{[]string{strings.Repeat("x", maxPushOptionsSize/2), strings.Repeat("x", maxPushOptionsSize/2+1)}, false},
+	} {
+		push := &receivePackRequest{PushOptions: tc.options}
+		if allowed := push.checkPushOptions() == ""; allowed != tc.allowed {
+			t.Errorf("%d options: expected allowed=%v", len(tc.options), tc.allowed)
+		}
+	}
+}
@@ -1,18 +1,94 @@
 package git
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
-func handleReceivePack(w *GitHttpResponseWriter, r *http.Request, a *api.Response) (writtenIn int64, err error) {
-	body := r.Body
+func handleReceivePack(w *GitHttpResponseWriter, r *http.Request, a *api.Response, scanner *pushScanner) (writtenIn int64, err error) {
+	body := bufio.NewReader(r.Body)
 	action := getService(r)
-	cmd, stdin, stdout, err := setupGitCommand(action, a)
+
+	push, err := parseReceivePackRequest(body)
+	if err != nil {
+		fail500(w)
+		return writtenIn, err
+	}
+
+	if msg := push.checkPushOptions(); msg != "" {
+		log.Printf("handleReceivePack: %s %q: push denied: %s", r.Method, r.RequestURI, msg)
+		return writtenIn, rejectPush(w, action, push, "ok", nil, msg)
+	}
+
+	reasons, forcePushChecks := checkRefRules(push, a.RefRules)
+	if len(reasons) > 0 {
+		log.Printf("handleReceivePack: %s %q: ref updates denied: %v", r.Method, r.RequestURI, reasons)
+		return writtenIn, rejectPush(w, action, push, "ok", reasons, "other ref updates in this push were denied")
+	}
+
+	var pack io.Reader = newPushSizeLimiter(body, a)
+	if push.hasNewObjects() && (scanner != nil || len(forcePushChecks) > 0) {
+		// We look at the objects in a quarantine of our own. Once we accept
+		// them Git gets the pack as the client sent it, and moves the
+		// objects into the repository before it updates any refs.
+		q, err := newPushQuarantine(a)
+		if err != nil {
+			fail500(w)
+			return writtenIn, err
+		}
+		defer q.remove()
+
+		err = q.receive(r.Context(), a, pack)
+		if sizeErr, ok := err.(*pushSizeError); ok {
+			log.Printf("handleReceivePack: %s %q: %v", r.Method, r.RequestURI, sizeErr)
+			return writtenIn, rejectPush(w, action, push, sizeErr.Error(), nil, sizeErr.reason)
+		}
+		if err != nil {
+			if rejectErr := rejectPush(w, action, push, "index-pack abnormal exit", nil, "unpacker error"); rejectErr != nil {
+				return writtenIn, rejectErr
+			}
+			return writtenIn, helper.PrefixError("receive pack", err)
+		}
+
+		reasons, err := checkForcePushes(r.Context(), a, q.env, forcePushChecks)
+		if err != nil {
+			if rejectErr := rejectPush(w, action, push, "ok", nil, "force push check failed"); rejectErr != nil {
+				return writtenIn, rejectErr
+			}
+			return writtenIn, helper.PrefixError("check force pushes", err)
+		}
+		if len(reasons) > 0 {
+			log.Printf("handleReceivePack: %s %q: ref updates denied: %v", r.Method, r.RequestURI, reasons)
+			return writtenIn, rejectPush(w, action, push, "ok", reasons, "other ref updates in this push were denied")
+		}
+
+		if scanner != nil {
+			rejections, err := scanner.scan(r.Context(), a, push, q)
+			if err != nil {
+				if rejectErr := rejectPush(w, action, push, "ok", nil, "content scan failed"); rejectErr != nil {
+					return writtenIn, rejectErr
+				}
+				return writtenIn, helper.PrefixError("scan push", err)
+			}
+			if len(rejections) > 0 {
+				log.Printf("handleReceivePack: %s %q: ref updates rejected by content scan: %v", r.Method, r.RequestURI, rejections)
+				return writtenIn, rejectPush(w, action, push, "ok", rejections, "other ref updates in this push were rejected by the content scan")
+			}
+		}
+
+		if pack, err = q.pack(); err != nil {
+			fail500(w)
+			return writtenIn, err
+		}
+	}
+
+	cmd, stdin, stdout, err := setupGitCommand(action, a, hideRefsConfig(a), push.pushOptionsEnv())
 
 	if err != nil {
 		fail500(w)
@@ -22,9 +98,21 @@ func handleReceivePack(w *GitHttpResponseWriter, r *http.Request, a *api.Respons
 	defer stdout.Close()
 	defer stdin.Close()
 	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(r.Context(), "receive-pack", cmd)()
+	// Git may have updated refs even if the push fails half way
+	defer infoRefsCache.invalidate(a.RepoPath)
 
 	// Write the client request body to Git's standard input
-	writtenIn, err = io.Copy(stdin, body)
+	writtenIn, err = io.Copy(stdin, io.MultiReader(&push.raw, pack))
+
+	if sizeErr, ok := err.(*pushSizeError); ok {
+		// Stop Git before it writes any more of the pack to disk. We do not
+		// read the rest of the request body; net/http will close the
+		// connection after we respond.
+		helper.CleanUpProcessGroup(cmd)
+		log.Printf("handleReceivePack: %s %q: %v", r.Method, r.RequestURI, sizeErr)
+		return writtenIn, rejectPush(w, action, push, sizeErr.Error(), nil, sizeErr.reason)
+	}
 
 	if err != nil {
 		fail500(w)
@@ -49,8 +137,77 @@ func handleReceivePack(w *GitHttpResponseWriter, r *http.Request, a *api.Respons
 	err = cmd.Wait()
 
 	if err != nil {
-		return writtenIn, fmt.Errorf("wait for %v: %v", cmd.Args, err)
+		return writtenIn, helper.NewProcessError(cmd, fmt.Errorf("wait for %v: %v", cmd.Args, err))
 	}
 
 	return writtenIn, nil
 }
+
+// rejectPush answers a push without running 'git receive-pack'
+func rejectPush(w http.ResponseWriter, action string, push *receivePackRequest, unpackStatus string, reasons map[string]string, defaultReason string) error {
+	writePostRPCHeader(w, action)
+	if err := push.writeRejection(w, unpackStatus, reasons, defaultReason); err != nil {
+		return &copyError{fmt.Errorf("write report-status: %v", err)}
+	}
+	return nil
+}
+
+type pushSizeError struct {
+	limit  int64
+	reason string
+}
+
+func (e *pushSizeError) Error() string {
+	return fmt.Sprintf("%s (limit %d bytes)", e.reason, e.limit)
+}
+
+// pushSizeLimiter passes through at most limit bytes of pack data and
+// returns a *pushSizeError as soon as the client sends more.
+type pushSizeLimiter struct {
+	r        io.Reader
+	n        int64
+	limitErr *pushSizeError
+}
+
+// newPushSizeLimiter applies the smallest of the pack size limit and the
+// remaining storage quota in a to r. If neither is set r is returned as is.
+func newPushSizeLimiter(r io.Reader, a *api.Response) io.Reader {
+	var limitErr *pushSizeError
+
+	if a.MaxPackSize > 0 {
+		limitErr = &pushSizeError{limit: a.MaxPackSize, reason: "pack exceeds maximum allowed size"}
+	}
+
+	if quota := a.StorageQuotaRemaining; quota != nil && (limitErr == nil || *quota < limitErr.limit) {
+		remaining := *quota
+		if remaining < 0 {
+			remaining = 0
+		}
+		limitErr = &pushSizeError{limit: remaining, reason: "repository storage quota exceeded"}
+	}
+
+	if limitErr == nil {
+		return r
+	}
+
+	return &pushSizeLimiter{r: r, limitErr: limitErr}
+}
+
+func (l *pushSizeLimiter) Read(p []byte) (int, error) {
+	if l.n > l.limitErr.limit {
+		return 0, l.limitErr
+	}
+
+	// Read one byte past the limit so we can tell when it is exceeded
+	if max := l.limitErr.limit - l.n + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limitErr.limit {
+		return n - int(l.n-l.limitErr.limit), l.limitErr
+	}
+
+	return n, err
+}
@@ -0,0 +1,130 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+// refFilter decides which refs a client gets to see. Prefixes match like
+// Git's transfer.hideRefs: "refs/foo" matches "refs/foo" and "refs/foo/bar"
+// but not "refs/foobar".
+type refFilter struct {
+	hide  []string
+	allow []string
+}
+
+func newRefFilter(a *api.Response) *refFilter {
+	if len(a.HideRefs) == 0 && len(a.AllowRefs) == 0 {
+		return nil
+	}
+
+	return &refFilter{hide: trimRefPrefixes(a.HideRefs), allow: trimRefPrefixes(a.AllowRefs)}
+}
+
+func trimRefPrefixes(prefixes []string) []string {
+	var trimmed []string
+	for _, p := range prefixes {
+		if p = strings.TrimSuffix(p, "/"); p != "" {
+			trimmed = append(trimmed, p)
+		}
+	}
+	return trimmed
+}
+
+func refMatchesPrefix(ref string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if ref == p || strings.HasPrefix(ref, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *refFilter) visible(ref string) bool {
+	if len(f.allow) > 0 && ref != "HEAD" && !refMatchesPrefix(ref, f.allow) {
+		return false
+	}
+	return !refMatchesPrefix(ref, f.hide)
+}
+
+// gitConfig returns transfer.hideRefs settings that make Git refuse
+// requests for the refs we do not advertise. Later entries take precedence
+// over earlier ones.
+func (f *refFilter) gitConfig() []string {
+	var config []string
+	if len(f.allow) > 0 {
+		config = append(config, "transfer.hideRefs=refs")
+		for _, p := range f.allow {
+			config = append(config, "transfer.hideRefs=!"+p)
+		}
+	}
+	for _, p := range f.hide {
+		config = append(config, "transfer.hideRefs="+p)
+	}
+	return config
+}
+
+// hideRefsConfig returns the Git configuration that hides the refs which the
+// preauth response a filters out, if any.
+func hideRefsConfig(a *api.Response) []string {
+	if filter := newRefFilter(a); filter != nil {
+		return filter.gitConfig()
+	}
+	return nil
+}
+
+// copy copies a ref advertisement from src to dst, leaving out hidden refs.
+// The capabilities that Git sends after the first ref move to the first
+// visible ref.
+func (f *refFilter) copy(dst io.Writer, src io.Reader) error {
+	var capabilities string
+	capabilitiesSent := false
+
+	scanner := bufio.NewScanner(src)
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		if len(line) == 0 {
+			if !capabilitiesSent && capabilities != "" {
+				// Every ref was hidden; this is how Git advertises an empty repository
+				if err := pktLine(dst, nullObjectID+" capabilities^{}\x00"+capabilities+"\n"); err != nil {
+					return err
+				}
+				capabilitiesSent = true
+			}
+			if err := pktFlush(dst); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if i := bytes.IndexByte(line, 0); i >= 0 {
+			capabilities = strings.TrimSuffix(string(line[i+1:]), "\n")
+			line = append(line[:i:i], '\n')
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) == 2 && len(fields[0]) == len(nullObjectID) {
+			ref := strings.TrimSuffix(fields[1], "^{}")
+			if ref != "capabilities" && ref != ".have" && !f.visible(ref) {
+				continue
+			}
+		}
+
+		out := string(line)
+		if !capabilitiesSent && capabilities != "" {
+			out = strings.TrimSuffix(out, "\n") + "\x00" + capabilities + "\n"
+			capabilitiesSent = true
+		}
+		if err := pktLine(dst, out); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,76 @@
+package git
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+const otherID = "abcdefabcdefabcdefabcdefabcdefabcdefabcd"
+
+func TestRefFilterCopy(t *testing.T) {
+	input := &bytes.Buffer{}
+	pktLine(input, someID+" HEAD\x00multi_ack side-band-64k\n")
+	pktLine(input, someID+" refs/heads/master\n")
+	pktLine(input, otherID+" refs/merge-requests/1/head\n")
+	pktLine(input, otherID+" refs/tags/v1.0\n")
+	pktLine(input, someID+" refs/tags/v1.0^{}\n")
+	pktFlush(input)
+
+	for _, tc := range []struct {
+		response api.Response
+		expected []string
+	}{
+		{
+			api.Response{HideRefs: []string{"refs/merge-requests/"}},
+			[]string{
+				someID + " HEAD\x00multi_ack side-band-64k\n",
+				someID + " refs/heads/master\n",
+				otherID + " refs/tags/v1.0\n",
+				someID + " refs/tags/v1.0^{}\n",
+			},
+		},
+		{
+			api.Response{AllowRefs: []string{"refs/tags"}, HideRefs: []string{"HEAD"}},
+			[]string{
+				otherID + " refs/tags/v1.0\x00multi_ack side-band-64k\n",
+				someID + " refs/tags/v1.0^{}\n",
+			},
+		},
+		{
+			api.Response{AllowRefs: []string{"refs/nothing"}, HideRefs: []string{"HEAD"}},
+			[]string{
+				nullObjectID + " capabilities^{}\x00multi_ack side-band-64k\n",
+			},
+		},
+	} {
+		expected := &bytes.Buffer{}
+		for _, line := range tc.expected {
+			pktLine(expected, line)
+		}
+		pktFlush(expected)
+
+		out := &bytes.Buffer{}
+		if err := newRefFilter(&tc.response).copy(out, bytes.NewReader(input.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+
+		if out.String() != expected.String() {
+			t.Errorf("%+v: expected %q, got %q", tc.response, expected.String(), out.String())
+		}
+	}
+}
+
+func TestHideRefsConfig(t *testing.T) {
+	if config := hideRefsConfig(&api.Response{}); config != nil {
+		t.Fatalf("expected no config, got %v", config)
+	}
+
+	config := hideRefsConfig(&api.Response{AllowRefs: []string{"refs/heads/"}, HideRefs: []string{"refs/heads/secret"}})
+	expected := []string{"transfer.hideRefs=refs", "transfer.hideRefs=!refs/heads", "transfer.hideRefs=refs/heads/secret"}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected %v, got %v", expected, config)
+	}
+}
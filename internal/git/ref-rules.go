@@ -0,0 +1,145 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const forcePushDeniedReason = "force pushing to this ref is not allowed"
+
+// checkRefRules returns a rejection reason for each ref update in push that
+// is not allowed by rules. Whether an update is a force push can only be
+// decided once we have the pushed objects, so instead of a reason we return
+// the updates in forcePushChecks, for checkForcePushes.
+func checkRefRules(push *receivePackRequest, rules []api.RefRule) (reasons map[string]string, forcePushChecks []refUpdate) {
+	reasons = make(map[string]string)
+
+	for _, cmd := range push.Commands {
+		denyForcePush := false
+		for _, rule := range rules {
+			if !rule.Matches(cmd.Ref) {
+				continue
+			}
+
+			if rule.Deny {
+				reasons[cmd.Ref] = "updating this ref is not allowed"
+				break
+			}
+
+			if rule.DenyDelete && cmd.isDelete() {
+				reasons[cmd.Ref] = "deleting this ref is not allowed"
+				break
+			}
+
+			if rule.DenyForcePush && !cmd.isCreate() && !cmd.isDelete() {
+				denyForcePush = true
+			}
+		}
+
+		if denyForcePush && reasons[cmd.Ref] == "" {
+			forcePushChecks = append(forcePushChecks, cmd)
+		}
+	}
+
+	return reasons, forcePushChecks
+}
+
+// checkForcePushes returns a rejection reason for each of updates that is
+// not a fast-forward, or whose old or new object is not a commit we have.
+// The Git environment env must give access to the pushed objects.
+func checkForcePushes(ctx context.Context, a *api.Response, env []string, updates []refUpdate) (map[string]string, error) {
+	reasons, err := checkForcePushCommits(ctx, a, env, updates)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range updates {
+		if reasons[u.Ref] != "" {
+			continue
+		}
+		fastForward, err := isAncestor(ctx, a, env, u.OldID, u.NewID)
+		if err != nil {
+			return nil, err
+		}
+		if !fastForward {
+			reasons[u.Ref] = forcePushDeniedReason
+		}
+	}
+	return reasons, nil
+}
+
+// checkForcePushCommits returns a rejection reason for each of updates
+// that 'git merge-base --is-ancestor' cannot check, because its old or new
+// object is missing or is not a commit
+func checkForcePushCommits(ctx context.Context, a *api.Response, env []string, updates []refUpdate) (map[string]string, error) {
+	reasons := make(map[string]string)
+	if len(updates) == 0 {
+		return reasons, nil
+	}
+
+	input := &bytes.Buffer{}
+	for _, u := range updates {
+		for _, id := range []string{u.OldID, u.NewID} {
+			fmt.Fprintf(input, "%s\n%s^{commit}\n", id, id)
+		}
+	}
+
+	cmd := gitCommand(a.GL_ID, env, "git", "--git-dir="+a.RepoPath, "cat-file", "--batch-check=%(objecttype)")
+	cmd.Stdin = input
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	helper.LimitProcess("receive-pack", cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %v: %v", cmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(ctx, "receive-pack", cmd)()
+
+	if err := cmd.Wait(); err != nil {
+		return nil, helper.NewProcessError(cmd, fmt.Errorf("wait for %v: %v", cmd.Args, err))
+	}
+
+	// Each object gives two lines: its type, and "commit" if it is or
+	// points to a commit. Missing objects give "<input> missing".
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 4*len(updates) {
+		return nil, fmt.Errorf("%v: expected %d lines, got %d", cmd.Args, 4*len(updates), len(lines))
+	}
+	for i, u := range updates {
+		for j, object := range []struct{ name, id string }{{"old", u.OldID}, {"new", u.NewID}} {
+			objectType, commit := lines[4*i+2*j], lines[4*i+2*j+1]
+			switch {
+			case strings.HasSuffix(objectType, " missing"):
+				reasons[u.Ref] = fmt.Sprintf("cannot check for a force push: %s object %s not found", object.name, object.id)
+			case commit != "commit":
+				reasons[u.Ref] = fmt.Sprintf("cannot check for a force push: %s object %s is a %s, not a commit", object.name, object.id, objectType)
+			default:
+				continue
+			}
+			break
+		}
+	}
+	return reasons, nil
+}
+
+func isAncestor(ctx context.Context, a *api.Response, env []string, ancestor, commit string) (bool, error) {
+	cmd := gitCommand(a.GL_ID, env, "git", "--git-dir="+a.RepoPath, "merge-base", "--is-ancestor", ancestor, commit)
+	helper.LimitProcess("receive-pack", cmd)
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("start %v: %v", cmd.Args, err)
+	}
+	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(ctx, "receive-pack", cmd)()
+
+	if err := cmd.Wait(); err != nil {
+		if status, ok := helper.ExitStatus(err); ok && status == 1 {
+			return false, nil
+		}
+		return false, helper.NewProcessError(cmd, fmt.Errorf("wait for %v: %v", cmd.Args, err))
+	}
+	return true, nil
+}
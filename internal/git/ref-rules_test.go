@@ -0,0 +1,90 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestHandleReceivePackDenyForcePush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ref-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The server has commit A on master and on feature. The client has B, a
+	// child of A, and C, which is unrelated to A.
+	client := filepath.Join(dir, "client")
+	server := filepath.Join(dir, "server.git")
+	runGit(t, dir, nil, "init", "-q", client)
+	runGit(t, dir, nil, "init", "-q", "--bare", server)
+	tree := strings.TrimSpace(string(runGit(t, client, nil, "mktree")))
+	commitA := strings.TrimSpace(string(runGit(t, client, nil, "commit-tree", "-m", "A", tree)))
+	commitB := strings.TrimSpace(string(runGit(t, client, nil, "commit-tree", "-m", "B", "-p", commitA, tree)))
+	commitC := strings.TrimSpace(string(runGit(t, client, nil, "commit-tree", "-m", "C", tree)))
+	runGit(t, client, nil, "push", "-q", server, commitA+":refs/heads/master", commitA+":refs/heads/feature")
+
+	rules := []api.RefRule{{Ref: "refs/heads/", DenyForcePush: true}}
+	push := func(updates ...refUpdate) string {
+		var tips []string
+		body := &bytes.Buffer{}
+		for i, u := range updates {
+			line := u.OldID + " " + u.NewID + " " + u.Ref
+			if i == 0 {
+				line += "\x00report-status"
+			}
+			pktLine(body, line+"\n")
+			tips = append(tips, u.NewID)
+		}
+		pktFlush(body)
+		body.Write(runGit(t, client, []byte(strings.Join(tips, "\n")+"\n^"+commitA+"\n"), "pack-objects", "--revs", "--stdout", "-q"))
+
+		req, err := http.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		if _, err := handleReceivePack(NewGitHttpResponseWriter(rr), req, &api.Response{RepoPath: server, RefRules: rules}, nil); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Body.String()
+	}
+
+	response := push(refUpdate{commitA, commitC, "refs/heads/master"}, refUpdate{commitA, commitB, "refs/heads/feature"})
+	for _, expected := range []string{"ng refs/heads/master " + forcePushDeniedReason + "\n", "ng refs/heads/feature other ref updates in this push were denied\n"} {
+		if !strings.Contains(response, expected) {
+			t.Fatalf("expected response to contain %q, got %q", expected, response)
+		}
+	}
+	if head := strings.TrimSpace(string(runGit(t, server, nil, "rev-parse", "refs/heads/feature"))); head != commitA {
+		t.Fatalf("expected feature to stay at %s, got %s", commitA, head)
+	}
+
+	// Old objects that are not commits we have reject only their own ref
+	unknown := strings.Repeat("1", 40)
+	response = push(refUpdate{tree, commitC, "refs/heads/master"}, refUpdate{unknown, commitB, "refs/heads/feature"})
+	for _, expected := range []string{
+		"ng refs/heads/master cannot check for a force push: old object " + tree + " is a tree, not a commit\n",
+		"ng refs/heads/feature cannot check for a force push: old object " + unknown + " not found\n",
+	} {
+		if !strings.Contains(response, expected) {
+			t.Fatalf("expected response to contain %q, got %q", expected, response)
+		}
+	}
+
+	response = push(refUpdate{commitA, commitB, "refs/heads/feature"})
+	if expected := "ok refs/heads/feature\n"; !strings.Contains(response, expected) {
+		t.Fatalf("expected response to contain %q, got %q", expected, response)
+	}
+	if head := strings.TrimSpace(string(runGit(t, server, nil, "rev-parse", "refs/heads/feature"))); head != commitB {
+		t.Fatalf("expected feature at %s, got %s", commitB, head)
+	}
+}
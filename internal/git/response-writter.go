@@ -77,6 +77,12 @@ func (w *GitHttpResponseWriter) WriteHeader(status int) {
 	w.rw.WriteHeader(status)
 }
 
+func (w *GitHttpResponseWriter) Flush() {
+	if flusher, ok := w.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func (w *GitHttpResponseWriter) Log(r *http.Request, writtenIn int64) {
 	service := getService(r)
 	agent := getRequestAgent(r)
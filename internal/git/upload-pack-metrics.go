@@ -0,0 +1,86 @@
+package git
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	fetchClassClone   = "clone"
+	fetchClassFetch   = "fetch"
+	fetchClassShallow = "shallow"
+	fetchClassPartial = "partial"
+)
+
+var (
+	negotiationBuckets = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 1024, 4096, 16384}
+
+	uploadPackWants = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_upload_pack_wants",
+			Help:    "How many 'want' lines Git upload-pack requests contain, partitioned by fetch class.",
+			Buckets: negotiationBuckets,
+		},
+		[]string{"class"},
+	)
+
+	uploadPackHaves = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_upload_pack_haves",
+			Help:    "How many 'have' lines Git upload-pack requests contain, partitioned by fetch class.",
+			Buckets: negotiationBuckets,
+		},
+		[]string{"class"},
+	)
+
+	uploadPackRounds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_upload_pack_negotiation_rounds",
+			Help:    "How many batches of 'have' lines Git upload-pack requests contain, partitioned by fetch class.",
+			Buckets: negotiationBuckets,
+		},
+		[]string{"class"},
+	)
+
+	uploadPackResponseBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_upload_pack_response_bytes",
+			Help:    "How many bytes, mostly pack data, gitlab-workhorse sent in response to Git upload-pack requests, partitioned by fetch class.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		},
+		[]string{"class"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadPackWants)
+	prometheus.MustRegister(uploadPackHaves)
+	prometheus.MustRegister(uploadPackRounds)
+	prometheus.MustRegister(uploadPackResponseBytes)
+}
+
+// fetchClass tells what kind of fetch req is. Partial clones and shallow
+// fetches are usually also clones; they get their own class because they
+// cost the server much less.
+func fetchClass(req *uploadPackRequest) string {
+	switch {
+	case len(req.Filters) > 0:
+		return fetchClassPartial
+	case req.Depth > 0 || req.DeepenSince || req.DeepenNot || req.Shallows > 0:
+		return fetchClassShallow
+	case req.Haves == 0:
+		return fetchClassClone
+	}
+	return fetchClassFetch
+}
+
+// observeUploadPack records the final request of a fetch, the one with
+// 'done'. A negotiation can take several HTTP requests, and each of them
+// repeats the 'want' lines and the 'have' lines that were found in common
+// so far, so counting the earlier ones would count a fetch twice.
+func observeUploadPack(req *uploadPackRequest, responseBytes int64) {
+	class := fetchClass(req)
+	uploadPackWants.WithLabelValues(class).Observe(float64(req.Wants))
+	uploadPackHaves.WithLabelValues(class).Observe(float64(req.Haves))
+	uploadPackRounds.WithLabelValues(class).Observe(float64(req.Rounds))
+	uploadPackResponseBytes.WithLabelValues(class).Observe(float64(responseBytes))
+}
@@ -0,0 +1,77 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestFetchClass(t *testing.T) {
+	for _, tc := range []struct {
+		req      uploadPackRequest
+		expected string
+	}{
+		{uploadPackRequest{Wants: 1, Done: true}, fetchClassClone},
+		{uploadPackRequest{Wants: 1, Haves: 10, Rounds: 1}, fetchClassFetch},
+		{uploadPackRequest{Wants: 1, Depth: 1}, fetchClassShallow},
+		{uploadPackRequest{Wants: 1, Haves: 1, Shallows: 1}, fetchClassShallow},
+		{uploadPackRequest{Wants: 1, Depth: 1, Filters: []string{"blob:none"}}, fetchClassPartial},
+	} {
+		if class := fetchClass(&tc.req); class != tc.expected {
+			t.Errorf("%+v: expected %s, got %s", tc.req, tc.expected, class)
+		}
+	}
+}
+
+func TestObserveUploadPackMultiRound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-pack-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, commitID, _, _ := setupPush(t, dir)
+	a := &api.Response{RepoPath: filepath.Join(dir, "client", ".git")}
+
+	before := uploadPackSampleCount(t, fetchClassFetch)
+	for _, done := range []bool{false, true} {
+		body := &bytes.Buffer{}
+		pktLine(body, "want "+commitID+" multi_ack_detailed side-band-64k\n")
+		pktFlush(body)
+		pktLine(body, "have "+someID+"\n")
+		if done {
+			pktLine(body, "done\n")
+		} else {
+			pktFlush(body)
+		}
+
+		req, err := http.NewRequest("POST", "/gitlab/gitlab-ce.git/git-upload-pack", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		if _, err := handleUploadPack(NewGitHttpResponseWriter(rr), req, a, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count := uploadPackSampleCount(t, fetchClassFetch) - before; count != 1 {
+		t.Fatalf("expected a fetch over two requests to be observed once, got %d", count)
+	}
+}
+
+func uploadPackSampleCount(t *testing.T, class string) uint64 {
+	m := &dto.Metric{}
+	if err := uploadPackWants.WithLabelValues(class).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,147 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+)
+
+const (
+	uploadPackQueueProgressInterval = time.Second
+
+	// A fetch without 'have' lines gets this response before the pack
+	// data. It is the only response we can predict without running Git.
+	uploadPackNAK = "0008NAK\n"
+)
+
+// uploadPackQueue limits the number of 'git upload-pack' processes that
+// run at the same time
+type uploadPackQueue struct {
+	queue   *queueing.Queue
+	timeout time.Duration
+}
+
+func newUploadPackQueue(cfg *config.Config) *uploadPackQueue {
+	if cfg.GitUploadPackLimit == 0 {
+		return nil
+	}
+
+	timeout := cfg.GitUploadPackQueueTimeout
+	if timeout == 0 {
+		timeout = queueing.DefaultTimeout
+	}
+
+	return &uploadPackQueue{
+		queue:   queueing.NewQueue(cfg.GitUploadPackLimit, cfg.GitUploadPackQueueLimit),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a slot to run 'git upload-pack'. It gives up when ctx
+// is done, e.g. because the client went away. While it waits it tells the
+// client its position in the queue, if the request allows us to do so
+// without breaking the protocol. In that case the response has already
+// started when acquire returns, startedResponse is true, and the output of
+// Git must go through forwardAfterNAK.
+func (q *uploadPackQueue) acquire(ctx context.Context, w *GitHttpResponseWriter, action string, req *uploadPackRequest) (startedResponse bool, err error) {
+	maxData := progressSidebandMaxData(req)
+	if maxData == 0 {
+		return false, q.queue.AcquireContext(ctx, q.timeout)
+	}
+
+	lastPosition := 0
+	var progressErr error
+	err = q.queue.AcquireWithProgress(ctx, q.timeout, uploadPackQueueProgressInterval, func(position int) {
+		if progressErr != nil || position == lastPosition {
+			return
+		}
+
+		if !startedResponse {
+			writePostRPCHeader(w, action)
+			if _, progressErr = io.WriteString(w, uploadPackNAK); progressErr != nil {
+				return
+			}
+			startedResponse = true
+		}
+
+		msg := fmt.Sprintf("GitLab: waiting for capacity (position %d)\n", position)
+		if progressErr = pktSideband(w, sidebandProgress, []byte(msg), maxData); progressErr != nil {
+			return
+		}
+		w.Flush()
+		lastPosition = position
+	})
+
+	if err != nil && startedResponse && ctx.Err() == nil {
+		// The client is expecting pack data now, so the only way left to
+		// report the error is the side-band error channel.
+		msg := fmt.Sprintf("GitLab: %v\n", err)
+		pktSideband(w, sidebandError, []byte(msg), maxData)
+	}
+	if err == nil && progressErr != nil {
+		q.queue.Release()
+		err = &copyError{fmt.Errorf("write queue progress: %v", progressErr)}
+	}
+
+	return startedResponse, err
+}
+
+func (q *uploadPackQueue) release() {
+	q.queue.Release()
+}
+
+// progressSidebandMaxData returns the maximum side-band packet payload if
+// we can send progress messages to the client before Git runs, or zero if
+// we cannot. We can only do this if we know what Git will send before the
+// pack data, and if the client negotiated side-band and wants progress.
+func progressSidebandMaxData(req *uploadPackRequest) int {
+	if req == nil || !req.Done || req.Haves > 0 || req.Shallows > 0 || req.isShallow() {
+		return 0
+	}
+
+	if req.hasCapability("no-progress") {
+		return 0
+	}
+
+	switch {
+	case req.hasCapability("side-band-64k"):
+		return sideband64kDataLimit
+	case req.hasCapability("side-band"):
+		return sidebandDataLimit
+	}
+	return 0
+}
+
+// forwardAfterNAK consumes the first packet that Git sends. For the
+// requests that progressSidebandMaxData accepts this is the NAK we already
+// sent to the client ourselves, or an ERR packet if Git rejects the
+// request. The client no longer accepts an ERR packet at this point, so we
+// pass its message on through the side-band error channel.
+func forwardAfterNAK(w io.Writer, stdout io.Reader, maxData int) error {
+	payload, err := readPktLine(stdout)
+	if err != nil {
+		return fmt.Errorf("read first packet: %v", err)
+	}
+
+	if string(payload) == "NAK\n" {
+		return nil
+	}
+
+	msg := []byte("GitLab: unexpected response from upload-pack\n")
+	if bytes.HasPrefix(payload, []byte("ERR ")) {
+		msg = bytes.TrimPrefix(payload, []byte("ERR "))
+		if !bytes.HasSuffix(msg, []byte("\n")) {
+			msg = append(msg, '\n')
+		}
+	}
+	if err := pktSideband(w, sidebandError, msg, maxData); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("expected NAK from git, got %q", payload)
+}
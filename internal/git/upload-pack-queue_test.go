@@ -0,0 +1,106 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+)
+
+func TestUploadPackQueueCancel(t *testing.T) {
+	q := newUploadPackQueue(&config.Config{GitUploadPackLimit: 1, GitUploadPackQueueLimit: 1})
+	if _, err := q.acquire(context.Background(), nil, "git-upload-pack", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer q.release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := q.acquire(ctx, nil, "git-upload-pack", nil)
+		done <- err
+	}()
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestUploadPackQueueProgress(t *testing.T) {
+	q := newUploadPackQueue(&config.Config{
+		GitUploadPackLimit:        1,
+		GitUploadPackQueueLimit:   1,
+		GitUploadPackQueueTimeout: 10 * time.Millisecond,
+	})
+	if _, err := q.acquire(context.Background(), nil, "git-upload-pack", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer q.release()
+
+	rw := httptest.NewRecorder()
+	req := &uploadPackRequest{Capabilities: []string{"side-band"}, Wants: 1, Done: true}
+	startedResponse, err := q.acquire(context.Background(), NewGitHttpResponseWriter(rw), "git-upload-pack", req)
+	if err != queueing.ErrQueueingTimedout {
+		t.Fatalf("expected %v, got %v", queueing.ErrQueueingTimedout, err)
+	}
+	if !startedResponse {
+		t.Fatal("expected the response to have started")
+	}
+
+	expected := &bytes.Buffer{}
+	expected.WriteString(uploadPackNAK)
+	pktSideband(expected, sidebandProgress, []byte("GitLab: waiting for capacity (position 1)\n"), sidebandDataLimit)
+	pktSideband(expected, sidebandError, []byte("GitLab: queueing timedout\n"), sidebandDataLimit)
+	if rw.Body.String() != expected.String() {
+		t.Fatalf("expected %q, got %q", expected.String(), rw.Body.String())
+	}
+}
+
+func TestProgressSidebandMaxData(t *testing.T) {
+	for _, tc := range []struct {
+		req      *uploadPackRequest
+		expected int
+	}{
+		{nil, 0},
+		{&uploadPackRequest{Capabilities: []string{"side-band-64k"}, Wants: 1, Done: true}, sideband64kDataLimit},
+		{&uploadPackRequest{Capabilities: []string{"side-band"}, Wants: 1, Done: true}, sidebandDataLimit},
+		{&uploadPackRequest{Wants: 1, Done: true}, 0},
+		{&uploadPackRequest{Capabilities: []string{"side-band-64k", "no-progress"}, Wants: 1, Done: true}, 0},
+		{&uploadPackRequest{Capabilities: []string{"side-band-64k"}, Wants: 1, Haves: 1, Done: true}, 0},
+		{&uploadPackRequest{Capabilities: []string{"side-band-64k"}, Wants: 1, Depth: 1, Done: true}, 0},
+		{&uploadPackRequest{Capabilities: []string{"side-band-64k"}, Wants: 1}, 0},
+	} {
+		if maxData := progressSidebandMaxData(tc.req); maxData != tc.expected {
+			t.Errorf("%+v: expected %d, got %d", tc.req, tc.expected, maxData)
+		}
+	}
+}
+
+func TestForwardAfterNAK(t *testing.T) {
+	w := &bytes.Buffer{}
+	stdout := strings.NewReader(uploadPackNAK + "0006\x01P")
+	if err := forwardAfterNAK(w, stdout, sidebandDataLimit); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.Len() != 6 || w.Len() != 0 {
+		t.Fatalf("expected pack data to remain unsent, %d bytes left, %q written", stdout.Len(), w.String())
+	}
+
+	w.Reset()
+	errStdout := &bytes.Buffer{}
+	pktError(errStdout, "upload-pack: not our ref "+someID)
+	if err := forwardAfterNAK(w, errStdout, sidebandDataLimit); err == nil {
+		t.Fatal("expected error for ERR response")
+	}
+	expected := &bytes.Buffer{}
+	pktSideband(expected, sidebandError, []byte("upload-pack: not our ref "+someID+"\n"), sidebandDataLimit)
+	if w.String() != expected.String() {
+		t.Fatalf("expected %q, got %q", expected.String(), w.String())
+	}
+}
@@ -0,0 +1,190 @@
+/*
+In this file we parse the negotiation lines of a 'git-upload-pack'
+request and check them against the upload-pack policy
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+// infiniteDepth is the 'deepen' value of 'git fetch --unshallow', which
+// asks for the full history rather than a shallow one
+const infiniteDepth = 0x7fffffff
+
+type uploadPackRequest struct {
+	Capabilities []string
+	Wants        int
+	Haves        int
+	Rounds       int // Number of batches of 'have' lines, i.e. negotiation rounds
+	Shallows     int // Number of commits the client already has as shallow boundaries
+	Depth        int // Largest 'deepen' value, zero if the fetch is not shallow
+	DeepenSince  bool
+	DeepenNot    bool
+	Filters      []string
+	Done         bool
+}
+
+// parseUploadPackRequest returns an error that can be shown to the client
+// if body is not a valid upload-pack request
+func parseUploadPackRequest(body io.Reader) (*uploadPackRequest, error) {
+	req := &uploadPackRequest{}
+
+	batchHaves := 0
+	scanner := bufio.NewScanner(body)
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		line := string(bytes.TrimSuffix(scanner.Bytes(), []byte("\n")))
+		if (line == "" || line == "done") && batchHaves > 0 {
+			// A flush packet or 'done' ends a batch of 'have' lines
+			req.Rounds++
+			batchHaves = 0
+		}
+
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			// Strip capabilities from the first 'want' line
+			line = line[:i]
+		}
+
+		command, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			command, arg = line[:i], line[i+1:]
+		}
+
+		switch command {
+		case "want":
+			if req.Wants == 0 {
+				// Capabilities follow the object ID on the first 'want' line
+				if fields := strings.Fields(arg); len(fields) > 1 {
+					req.Capabilities = fields[1:]
+				}
+			}
+			req.Wants++
+		case "have":
+			req.Haves++
+			batchHaves++
+		case "shallow":
+			req.Shallows++
+		case "deepen":
+			depth, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid depth %q", arg)
+			}
+			if depth > req.Depth {
+				req.Depth = depth
+			}
+		case "deepen-since":
+			req.DeepenSince = true
+		case "deepen-not":
+			req.DeepenNot = true
+		case "filter":
+			req.Filters = append(req.Filters, arg)
+		case "done":
+			req.Done = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if batchHaves > 0 {
+		req.Rounds++
+	}
+
+	return req, nil
+}
+
+func (req *uploadPackRequest) hasCapability(name string) bool {
+	for _, c := range req.Capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isShallow tells whether req asks for a shallow fetch
+func (req *uploadPackRequest) isShallow() bool {
+	return req.Depth > 0 || req.DeepenSince || req.DeepenNot
+}
+
+// checkUploadPackPolicy returns a message for the client if req violates
+// policy, or an empty string if the request is allowed.
+func checkUploadPackPolicy(req *uploadPackRequest, policy *api.UploadPackPolicy) string {
+	if policy.MaxWants > 0 && req.Wants > policy.MaxWants {
+		return fmt.Sprintf("too many wants: %d, maximum is %d", req.Wants, policy.MaxWants)
+	}
+
+	// Unshallowing a repository fetches the history that a shallow fetch
+	// within the limit left out, so it must not count as a deep fetch
+	if policy.MaxDepth > 0 && req.Depth > policy.MaxDepth && req.Depth != infiniteDepth {
+		return fmt.Sprintf("fetch depth %d exceeds maximum of %d", req.Depth, policy.MaxDepth)
+	}
+
+	if policy.DenyDeepenSince && req.DeepenSince {
+		return "shallow fetch with --shallow-since is not allowed"
+	}
+
+	if policy.DenyDeepenNot && req.DeepenNot {
+		return "shallow fetch with --shallow-exclude is not allowed"
+	}
+
+	for _, filter := range req.Filters {
+		if !filterAllowed(filter, policy.AllowedFilters) {
+			return fmt.Sprintf("filter %q is not allowed", filter)
+		}
+	}
+
+	return ""
+}
+
+func filterAllowed(filter string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, a := range allowed {
+		if filter == a || strings.HasPrefix(filter, a+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mergeUploadPackPolicy returns the configured policy with the non-zero
+// fields of override applied on top. It returns nil if the result does not
+// limit anything.
+func mergeUploadPackPolicy(configured api.UploadPackPolicy, override *api.UploadPackPolicy) *api.UploadPackPolicy {
+	policy := configured
+	if override == nil {
+		override = &api.UploadPackPolicy{}
+	}
+
+	if override.MaxWants > 0 {
+		policy.MaxWants = override.MaxWants
+	}
+	if override.MaxDepth > 0 {
+		policy.MaxDepth = override.MaxDepth
+	}
+	if len(override.AllowedFilters) > 0 {
+		policy.AllowedFilters = override.AllowedFilters
+	}
+	policy.DenyDeepenSince = policy.DenyDeepenSince || override.DenyDeepenSince
+	policy.DenyDeepenNot = policy.DenyDeepenNot || override.DenyDeepenNot
+
+	if policy.MaxWants == 0 && policy.MaxDepth == 0 && len(policy.AllowedFilters) == 0 &&
+		!policy.DenyDeepenSince && !policy.DenyDeepenNot {
+		return nil
+	}
+
+	return &policy
+}
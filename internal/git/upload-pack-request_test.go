@@ -0,0 +1,108 @@
+package git
+
+import (
+	"bytes"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestParseUploadPackRequest(t *testing.T) {
+	input := &bytes.Buffer{}
+	pktLine(input, "want "+someID+" multi_ack side-band-64k\n")
+	pktLine(input, "want "+someID+"\n")
+	pktLine(input, "deepen 3\n")
+	pktLine(input, "filter blob:limit=1024\n")
+	pktFlush(input)
+	pktLine(input, "have "+someID+"\n")
+	pktFlush(input)
+	pktLine(input, "have "+someID+"\n")
+	pktLine(input, "done\n")
+
+	req, err := parseUploadPackRequest(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := uploadPackRequest{Wants: 2, Haves: 2, Rounds: 2, Depth: 3, Done: true}
+	if req.Wants != expected.Wants || req.Haves != expected.Haves || req.Rounds != expected.Rounds || req.Depth != expected.Depth || req.Done != expected.Done {
+		t.Fatalf("expected %+v, got %+v", expected, *req)
+	}
+	if !req.hasCapability("side-band-64k") || req.hasCapability("no-progress") {
+		t.Fatalf("unexpected capabilities %v", req.Capabilities)
+	}
+	if len(req.Filters) != 1 || req.Filters[0] != "blob:limit=1024" {
+		t.Fatalf("unexpected filters %v", req.Filters)
+	}
+}
+
+func TestParseUploadPackRequestInvalidDepth(t *testing.T) {
+	input := &bytes.Buffer{}
+	pktLine(input, "want "+someID+"\n")
+	pktLine(input, "deepen x\n")
+	pktFlush(input)
+
+	_, err := parseUploadPackRequest(input)
+	if err == nil || err.Error() != `invalid depth "x"` {
+		t.Fatalf("expected invalid depth error, got %v", err)
+	}
+}
+
+func TestUploadPackRequestIsShallow(t *testing.T) {
+	for _, example := range []struct {
+		input  string
+		output bool
+	}{
+		{"000dsomething000cdeepen 10000", true},
+		{"000dsomething0000000cdeepen 1", true},
+		{"0015deepen-since 1234", true},
+		{"000dsomething0000", false},
+		{"invalid data", false},
+		{"deepen", false},
+		{"000cdeepen", false},
+	} {
+		req, err := parseUploadPackRequest(bytes.NewReader([]byte(example.input)))
+		if shallow := err == nil && req.isShallow(); shallow != example.output {
+			t.Errorf("%q: expected shallow=%v, got %v", example.input, example.output, shallow)
+		}
+	}
+}
+
+func TestCheckUploadPackPolicy(t *testing.T) {
+	policy := &api.UploadPackPolicy{
+		MaxWants:        2,
+		MaxDepth:        10,
+		AllowedFilters:  []string{"blob:none", "blob:limit"},
+		DenyDeepenSince: true,
+	}
+
+	for _, tc := range []struct {
+		req     uploadPackRequest
+		allowed bool
+	}{
+		{uploadPackRequest{Wants: 2, Depth: 10}, true},
+		{uploadPackRequest{Wants: 3}, false},
+		{uploadPackRequest{Wants: 1, Depth: 11}, false},
+		{uploadPackRequest{Wants: 1, Depth: infiniteDepth}, true},
+		{uploadPackRequest{Wants: 1, DeepenSince: true}, false},
+		{uploadPackRequest{Wants: 1, DeepenNot: true}, true},
+		{uploadPackRequest{Wants: 1, Filters: []string{"blob:limit=1m", "blob:none"}}, true},
+		{uploadPackRequest{Wants: 1, Filters: []string{"tree:0"}}, false},
+	} {
+		msg := checkUploadPackPolicy(&tc.req, policy)
+		if allowed := msg == ""; allowed != tc.allowed {
+			t.Errorf("%+v: expected allowed=%v, got message %q", tc.req, tc.allowed, msg)
+		}
+	}
+}
+
+func TestMergeUploadPackPolicy(t *testing.T) {
+	if policy := mergeUploadPackPolicy(api.UploadPackPolicy{}, nil); policy != nil {
+		t.Fatalf("expected no policy, got %+v", policy)
+	}
+
+	policy := mergeUploadPackPolicy(api.UploadPackPolicy{MaxWants: 10, MaxDepth: 5}, &api.UploadPackPolicy{MaxWants: 100, DenyDeepenNot: true})
+	if policy.MaxWants != 100 || policy.MaxDepth != 5 || !policy.DenyDeepenNot {
+		t.Fatalf("unexpected merged policy %+v", policy)
+	}
+}
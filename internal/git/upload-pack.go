@@ -3,13 +3,15 @@ package git
 import (
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 )
 
-func handleUploadPack(w *GitHttpResponseWriter, r *http.Request, a *api.Response) (writtenIn int64, err error) {
+func handleUploadPack(w *GitHttpResponseWriter, r *http.Request, a *api.Response, queue *uploadPackQueue) (writtenIn int64, err error) {
 	// The body will consist almost entirely of 'have XXX' and 'want XXX'
 	// lines; these are about 50 bytes long. With a limit of 10MB the client
 	// can send over 200,000 have/want lines.
@@ -21,14 +23,73 @@ func handleUploadPack(w *GitHttpResponseWriter, r *http.Request, a *api.Response
 	defer buffer.Close()
 	r.Body.Close()
 
-	isShallowClone := scanDeepen(buffer)
+	action := getService(r)
+
+	// One parse of the request serves the policy checks, the metrics and
+	// the shallow clone detection below
+	req, parseErr := parseUploadPackRequest(buffer)
 	if _, err := buffer.Seek(0, 0); err != nil {
 		fail500(w)
 		return writtenIn, fmt.Errorf("seek tempfile: %v", err)
 	}
+	isShallowClone := false
+	if parseErr != nil {
+		// Leave it to Git to reject the request, unless we need to enforce a
+		// policy on it
+		req = nil
+	} else {
+		isShallowClone = req.isShallow()
+		if req.Done {
+			defer func() { observeUploadPack(req, w.written) }()
+		}
+	}
 
-	action := getService(r)
-	cmd, stdin, stdout, err := setupGitCommand(action, a)
+	if a.UploadPackPolicy != nil {
+		var msg string
+		if parseErr != nil {
+			msg = fmt.Sprintf("invalid upload-pack request: %v", parseErr)
+		} else {
+			msg = checkUploadPackPolicy(req, a.UploadPackPolicy)
+		}
+		if msg != "" {
+			log.Printf("handleUploadPack: %s %q: request denied: %s", r.Method, r.RequestURI, msg)
+
+			writePostRPCHeader(w, action)
+			if err := pktError(w, msg); err != nil {
+				return writtenIn, &copyError{fmt.Errorf("write ERR packet: %v", err)}
+			}
+			return writtenIn, nil
+		}
+	}
+
+	sentNAK := false
+	if queue != nil {
+		sentNAK, err = queue.acquire(r.Context(), w, action, req)
+		switch {
+		case err == nil:
+			defer queue.release()
+		case sentNAK && r.Context().Err() == nil:
+			// acquire has told the client on the side-band error channel
+			if _, ok := err.(*copyError); ok {
+				return writtenIn, err
+			}
+			return writtenIn, nil
+		case err == queueing.ErrTooManyRequests:
+			helper.TooManyRequests(w, r, err)
+			return writtenIn, nil
+		case err == queueing.ErrQueueingTimedout:
+			helper.ServiceUnavailable(w, r, err)
+			return writtenIn, nil
+		case r.Context().Err() != nil:
+			// The client went away while it was waiting
+			return writtenIn, &copyError{fmt.Errorf("wait for upload-pack slot: %v", err)}
+		default:
+			fail500(w)
+			return writtenIn, err
+		}
+	}
+
+	cmd, stdin, stdout, err := setupGitCommand(action, a, hideRefsConfig(a), nil)
 
 	if err != nil {
 		fail500(w)
@@ -38,10 +99,18 @@ func handleUploadPack(w *GitHttpResponseWriter, r *http.Request, a *api.Response
 	defer stdout.Close()
 	defer stdin.Close()
 	defer helper.CleanUpProcessGroup(cmd) // Ensure brute force subprocess clean-up
+	defer helper.WatchProcessGroup(r.Context(), "upload-pack", cmd)()
 
 	stdoutError := make(chan error, 1)
 	go func() {
-		writePostRPCHeader(w, action)
+		if sentNAK {
+			if err := forwardAfterNAK(w, stdout, progressSidebandMaxData(req)); err != nil {
+				stdoutError <- err
+				return
+			}
+		} else {
+			writePostRPCHeader(w, action)
+		}
 		// Start reading from stdout already to avoid blocking while writing to
 		// stdin below.
 		_, err := io.Copy(w, stdout)
@@ -65,7 +134,7 @@ func handleUploadPack(w *GitHttpResponseWriter, r *http.Request, a *api.Response
 	err = cmd.Wait()
 
 	if err != nil && !(isExitError(err) && isShallowClone) {
-		return writtenIn, fmt.Errorf("wait for %v: %v", cmd.Args, err)
+		return writtenIn, helper.NewProcessError(cmd, fmt.Errorf("wait for %v: %v", cmd.Args, err))
 	}
 
 	return writtenIn, nil
@@ -2,6 +2,7 @@ package helper
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"mime"
 	"net"
@@ -39,10 +40,15 @@ func TooManyRequests(w http.ResponseWriter, r *http.Request, err error) {
 }
 
 func printError(r *http.Request, err error) {
+	details := ""
+	if e, ok := err.(*ProcessError); ok {
+		details = fmt.Sprintf(" args=%q exit_status=%d stderr=%q", e.Args, e.ExitStatus, e.Stderr)
+	}
+
 	if r != nil {
-		log.Printf("error: %s %q: %v", r.Method, r.RequestURI, err)
+		log.Printf("error: %s %q: %v%s", r.Method, r.RequestURI, err, details)
 	} else {
-		log.Printf("error: %v", err)
+		log.Printf("error: %v%s", err, details)
 	}
 }
 
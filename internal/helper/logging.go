@@ -105,6 +105,12 @@ func (l *loggingResponseWriter) WriteHeader(status int) {
 	l.rw.WriteHeader(status)
 }
 
+func (l *loggingResponseWriter) Flush() {
+	if flusher, ok := l.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func (l *loggingResponseWriter) Log(r *http.Request) {
 	duration := time.Since(l.started)
 	responseLogger.Printf("%s %s - - [%s] %q %d %d %q %q %f\n",
@@ -0,0 +1,192 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cancelledSubprocesses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_cancelled_subprocesses",
+			Help: "How many subprocesses have been killed by gitlab-workhorse because their request was cancelled, partitioned by command kind.",
+		},
+		[]string{"kind"},
+	)
+
+	timedOutSubprocesses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_timed_out_subprocesses",
+			Help: "How many subprocesses have been killed by gitlab-workhorse because they exceeded their timeout, partitioned by command kind.",
+		},
+		[]string{"kind"},
+	)
+
+	processLimitErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_subprocess_limit_errors",
+			Help: "How many times gitlab-workhorse failed to apply resource limits to a subprocess, partitioned by command kind.",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cancelledSubprocesses)
+	prometheus.MustRegister(timedOutSubprocesses)
+	prometheus.MustRegister(processLimitErrors)
+}
+
+// processKillGracePeriod is how long a process group that got SIGTERM has to
+// exit before it gets SIGKILL
+var processKillGracePeriod = 10 * time.Second
+
+// ProcessLimits restricts the resources of a subprocess. Zero values mean
+// no limit.
+type ProcessLimits struct {
+	Timeout         time.Duration
+	Nice            int
+	IOClass         int // 1 real-time, 2 best-effort, 3 idle; see ioprio_set(2)
+	IOLevel         int
+	MaxAddressSpace uint64 // bytes
+	MaxOpenFiles    uint64
+}
+
+func (l ProcessLimits) String() string {
+	return fmt.Sprintf("timeout=%v nice=%d ioclass=%d iolevel=%d as=%d nofile=%d", l.Timeout, l.Nice, l.IOClass, l.IOLevel, l.MaxAddressSpace, l.MaxOpenFiles)
+}
+
+var processLimits struct {
+	sync.RWMutex
+	byKind map[string]ProcessLimits
+}
+
+// SetProcessLimits sets the limits for each kind of subprocess, e.g.
+// "archive" or "upload-pack".
+func SetProcessLimits(limits map[string]ProcessLimits) {
+	processLimits.Lock()
+	defer processLimits.Unlock()
+	processLimits.byKind = limits
+}
+
+func getProcessLimits(kind string) ProcessLimits {
+	processLimits.RLock()
+	defer processLimits.RUnlock()
+	return processLimits.byKind[kind]
+}
+
+// LoadProcessLimits reads subprocess limits from a JSON file of the form
+//
+//	{"archive": {"timeout": "10m", "nice": 10, "ionice_class": 3, "max_address_space": 2147483648, "max_open_files": 1024}}
+func LoadProcessLimits(path string) (map[string]ProcessLimits, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]struct {
+		Timeout         string `json:"timeout"`
+		Nice            int    `json:"nice"`
+		IOClass         int    `json:"ionice_class"`
+		IOLevel         int    `json:"ionice_level"`
+		MaxAddressSpace uint64 `json:"max_address_space"`
+		MaxOpenFiles    uint64 `json:"max_open_files"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	limits := make(map[string]ProcessLimits)
+	for kind, e := range entries {
+		l := ProcessLimits{
+			Nice:            e.Nice,
+			IOClass:         e.IOClass,
+			IOLevel:         e.IOLevel,
+			MaxAddressSpace: e.MaxAddressSpace,
+			MaxOpenFiles:    e.MaxOpenFiles,
+		}
+		if e.Timeout != "" {
+			if l.Timeout, err = time.ParseDuration(e.Timeout); err != nil {
+				return nil, fmt.Errorf("parse %s: %q: %v", path, kind, err)
+			}
+		}
+		limits[kind] = l
+	}
+	return limits, nil
+}
+
+// LimitProcess makes the command cmd, which has not been started yet, run
+// with the priorities and rlimits configured for subprocesses of the given
+// kind. If that is not possible the command runs without them.
+func LimitProcess(kind string, cmd *exec.Cmd) {
+	if err := limitCommand(cmd, getProcessLimits(kind)); err != nil {
+		processLimitErrors.WithLabelValues(kind).Inc()
+		log.Printf("LimitProcess: %s %v: %v", kind, cmd.Args, err)
+	}
+}
+
+// WatchProcessGroup sends SIGTERM to the process group of the started
+// command cmd as soon as ctx is done, e.g. because the client
+// disconnected, or when the command runs longer than the timeout
+// configured for subprocesses of the given kind. If the process group is
+// still around processKillGracePeriod later it gets SIGKILL. Call the
+// returned function once the command is no longer needed; after it returns
+// the process group will not be signalled.
+func WatchProcessGroup(ctx context.Context, kind string, cmd *exec.Cmd) (stop func()) {
+	process := cmd.Process
+	if process == nil || process.Pid <= 0 {
+		return func() {}
+	}
+
+	limits := getProcessLimits(kind)
+
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if limits.Timeout > 0 {
+		timer = time.NewTimer(limits.Timeout)
+		timeout = timer.C
+	}
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-process.Pid, syscall.SIGTERM)
+			cancelledSubprocesses.WithLabelValues(kind).Inc()
+		case <-timeout:
+			syscall.Kill(-process.Pid, syscall.SIGTERM)
+			timedOutSubprocesses.WithLabelValues(kind).Inc()
+			log.Printf("WatchProcessGroup: %s %v: killed after exceeding timeout of %v", kind, cmd.Args, limits.Timeout)
+		case <-stopCh:
+			return
+		}
+
+		grace := time.NewTimer(processKillGracePeriod)
+		defer grace.Stop()
+		select {
+		case <-grace.C:
+			syscall.Kill(-process.Pid, syscall.SIGKILL)
+			log.Printf("WatchProcessGroup: %s %v: sent SIGKILL after SIGTERM was ignored for %v", kind, cmd.Args, processKillGracePeriod)
+		case <-stopCh:
+		}
+	}()
+
+	return func() {
+		close(stopCh)
+		<-done
+		if timeout != nil {
+			timer.Stop()
+		}
+	}
+}
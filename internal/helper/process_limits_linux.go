@@ -0,0 +1,61 @@
+package helper
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+const ioprioClassIdle = 3
+
+// limitCommand makes cmd start through prlimit(1), nice(1) and ionice(1),
+// as needed, so that the limits are in place before the command runs. Each
+// of these programs executes the next one, so the command keeps the PID
+// and process group of the first.
+func limitCommand(cmd *exec.Cmd, limits ProcessLimits) error {
+	var wrapper []string
+	wrap := func(name string, args ...string) error {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return err
+		}
+		wrapper = append(append(append(wrapper, path), args...), "--")
+		return nil
+	}
+
+	if limits.MaxAddressSpace != 0 || limits.MaxOpenFiles != 0 {
+		var args []string
+		if limits.MaxAddressSpace != 0 {
+			args = append(args, "--as="+strconv.FormatUint(limits.MaxAddressSpace, 10))
+		}
+		if limits.MaxOpenFiles != 0 {
+			args = append(args, "--nofile="+strconv.FormatUint(limits.MaxOpenFiles, 10))
+		}
+		if err := wrap("prlimit", args...); err != nil {
+			return err
+		}
+	}
+
+	if limits.Nice != 0 {
+		if err := wrap("nice", "-n", strconv.Itoa(limits.Nice)); err != nil {
+			return err
+		}
+	}
+
+	if limits.IOClass != 0 {
+		args := []string{"-c", strconv.Itoa(limits.IOClass)}
+		if limits.IOClass != ioprioClassIdle {
+			args = append(args, "-n", strconv.Itoa(limits.IOLevel))
+		}
+		if err := wrap("ionice", args...); err != nil {
+			return err
+		}
+	}
+
+	if len(wrapper) == 0 {
+		return nil
+	}
+
+	cmd.Args = append(append(wrapper, cmd.Path), cmd.Args[1:]...)
+	cmd.Path = wrapper[0]
+	return nil
+}
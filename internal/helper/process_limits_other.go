@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package helper
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func limitCommand(cmd *exec.Cmd, limits ProcessLimits) error {
+	if limits == (ProcessLimits{Timeout: limits.Timeout}) {
+		return nil
+	}
+	return errors.New("priorities and rlimits are only supported on Linux")
+}
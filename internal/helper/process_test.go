@@ -0,0 +1,138 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func startSleep(t *testing.T) *exec.Cmd {
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func expectKilled(t *testing.T, cmd *exec.Cmd) {
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- cmd.Wait() }()
+
+	select {
+	case err := <-waitErr:
+		if err == nil {
+			t.Fatal("expected process to be killed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("process was not killed")
+	}
+}
+
+func TestWatchProcessGroupCancel(t *testing.T) {
+	cmd := startSleep(t)
+	defer CleanUpProcessGroup(cmd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer WatchProcessGroup(ctx, "test", cmd)()
+
+	cancel()
+	expectKilled(t, cmd)
+}
+
+func TestWatchProcessGroupTimeout(t *testing.T) {
+	SetProcessLimits(map[string]ProcessLimits{"test": {Timeout: 10 * time.Millisecond}})
+	defer SetProcessLimits(nil)
+
+	cmd := startSleep(t)
+	defer CleanUpProcessGroup(cmd)
+	defer WatchProcessGroup(context.Background(), "test", cmd)()
+
+	expectKilled(t, cmd)
+}
+
+func TestWatchProcessGroupKill(t *testing.T) {
+	SetProcessLimits(map[string]ProcessLimits{"test": {Timeout: 10 * time.Millisecond}})
+	defer SetProcessLimits(nil)
+	defer func(d time.Duration) { processKillGracePeriod = d }(processKillGracePeriod)
+	processKillGracePeriod = 10 * time.Millisecond
+
+	cmd := exec.Command("sh", "-c", "trap '' TERM; echo ready; sleep 30 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer CleanUpProcessGroup(cmd)
+	defer WatchProcessGroup(context.Background(), "test", cmd)()
+
+	// Wait until the shell ignores SIGTERM
+	if _, err := stdout.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	expectKilled(t, cmd)
+}
+
+func TestLimitProcess(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("priorities and rlimits are only supported on Linux")
+	}
+
+	output, err := exec.Command("nice").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	niceness, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetProcessLimits(map[string]ProcessLimits{"test": {Nice: 5, MaxOpenFiles: 64}})
+	defer SetProcessLimits(nil)
+
+	cmd := exec.Command("sh", "-c", "echo $(nice) $(ulimit -n)")
+	LimitProcess("test", cmd)
+	output, err = cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fmt.Sprintf("%d 64", niceness+5)
+	if got := strings.TrimSpace(string(output)); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestLoadProcessLimits(t *testing.T) {
+	file, err := ioutil.TempFile("", "limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(`{"archive": {"timeout": "10m", "nice": 10, "ionice_class": 3, "max_open_files": 1024}}`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	limits, err := LoadProcessLimits(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ProcessLimits{Timeout: 10 * time.Minute, Nice: 10, IOClass: 3, MaxOpenFiles: 1024}
+	if limits["archive"] != expected {
+		t.Fatalf("expected %v, got %v", expected, limits["archive"])
+	}
+}
@@ -29,6 +29,11 @@ func captureRavenError(r *http.Request, err error) {
 	interfaces = append(interfaces, exception)
 
 	packet := raven.NewPacket(err.Error(), interfaces...)
+	if e, ok := err.(*ProcessError); ok {
+		for k, v := range e.extra() {
+			packet.Extra[k] = v
+		}
+	}
 	client.Capture(packet, nil)
 }
 
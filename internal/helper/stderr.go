@@ -0,0 +1,127 @@
+package helper
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// Only keep the start of what a subprocess writes to stderr. Git prints the
+// reason it failed first, and we do not want a chatty subprocess to fill up
+// our memory or our log.
+const maxStderrSize = 16 * 1024
+
+// stderrLog is where StderrBuffer copies the stderr of every subprocess,
+// including the ones that succeed, if streamStderr is set
+var stderrLog io.Writer = os.Stderr
+var streamStderr bool
+
+// SetStreamStderr makes every StderrBuffer copy the stderr of its
+// subprocess to our own stderr as it comes in, e.g. for debugging. It must
+// be called before any subprocess starts.
+func SetStreamStderr(enabled bool) {
+	streamStderr = enabled
+}
+
+// StderrBuffer captures the stderr of a subprocess so that it can be logged
+// along with the request that started the subprocess.
+type StderrBuffer struct {
+	sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func NewStderrBuffer() *StderrBuffer {
+	return &StderrBuffer{}
+}
+
+func (b *StderrBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if streamStderr {
+		stderrLog.Write(p)
+	}
+
+	n := len(p)
+	if b.truncated {
+		return n, nil
+	}
+	if room := maxStderrSize - b.buf.Len(); n > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+
+	// Pretend we wrote everything, or the subprocess gets EPIPE
+	return n, nil
+}
+
+// Reset discards what has been captured so far. A subprocess that serves
+// several requests gets a Reset before each one, so that every request
+// only logs its own part of the stderr.
+func (b *StderrBuffer) Reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.buf.Reset()
+	b.truncated = false
+}
+
+func (b *StderrBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.truncated {
+		return b.buf.String() + "[truncated]"
+	}
+	return b.buf.String()
+}
+
+// ProcessError is an error caused by a subprocess. Its message is that of
+// the wrapped error; the error log entry and the Sentry event also get the
+// arguments, exit status and stderr of the subprocess.
+type ProcessError struct {
+	error
+	Args       []string
+	ExitStatus int // -1 if the subprocess did not exit normally
+	Stderr     string
+}
+
+// NewProcessError wraps err, which happened while running cmd, in a
+// ProcessError. The stderr of cmd is only available if it is a StderrBuffer.
+func NewProcessError(cmd *exec.Cmd, err error) error {
+	e := &ProcessError{error: err, Args: cmd.Args, ExitStatus: -1}
+	if cmd.ProcessState != nil {
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			e.ExitStatus = status.ExitStatus()
+		}
+	}
+	if stderr, ok := cmd.Stderr.(*StderrBuffer); ok {
+		e.Stderr = stderr.String()
+	}
+	return e
+}
+
+// PrefixError works like fmt.Errorf("%s: %v", prefix, err) but keeps the
+// subprocess details if err is a ProcessError.
+func PrefixError(prefix string, err error) error {
+	if e, ok := err.(*ProcessError); ok {
+		prefixed := *e
+		prefixed.error = fmt.Errorf("%s: %v", prefix, e.error)
+		return &prefixed
+	}
+	return fmt.Errorf("%s: %v", prefix, err)
+}
+
+func (e *ProcessError) extra() map[string]interface{} {
+	return map[string]interface{}{
+		"args":        e.Args,
+		"exit_status": e.ExitStatus,
+		"stderr":      e.Stderr,
+	}
+}
@@ -0,0 +1,91 @@
+package helper
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func streamStderrTo(w io.Writer) (restore func()) {
+	oldLog, oldStream := stderrLog, streamStderr
+	stderrLog, streamStderr = w, true
+	return func() { stderrLog, streamStderr = oldLog, oldStream }
+}
+
+func TestStderrBufferTruncates(t *testing.T) {
+	log := &bytes.Buffer{}
+	defer streamStderrTo(log)()
+
+	buf := NewStderrBuffer()
+	input := strings.Repeat("x", maxStderrSize+10)
+	if n, err := buf.Write([]byte(input)); n != len(input) || err != nil {
+		t.Fatalf("expected full write, got %d, %v", n, err)
+	}
+
+	if expected := input[:maxStderrSize] + "[truncated]"; buf.String() != expected {
+		t.Fatalf("expected %d bytes and truncation marker, got %d bytes", len(expected), len(buf.String()))
+	}
+	buf.Write([]byte("more"))
+	if log.String() != input+"more" {
+		t.Fatalf("expected all of stderr in the log, got %d bytes", log.Len())
+	}
+
+	buf.Reset()
+	buf.Write([]byte("next"))
+	if buf.String() != "next" {
+		t.Fatalf("expected %q after reset, got %q", "next", buf.String())
+	}
+}
+
+func TestStderrBufferLogsSuccessfulCommands(t *testing.T) {
+	log := &bytes.Buffer{}
+	defer streamStderrTo(log)()
+
+	cmd := exec.Command("sh", "-c", "echo warning >&2")
+	cmd.Stderr = NewStderrBuffer()
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log.String() != "warning\n" {
+		t.Fatalf("expected stderr in the log, got %q", log.String())
+	}
+
+	streamStderr = false
+	log.Reset()
+	cmd = exec.Command("sh", "-c", "echo warning >&2")
+	cmd.Stderr = NewStderrBuffer()
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if log.Len() != 0 {
+		t.Fatalf("expected no stderr in the log without streaming, got %q", log.String())
+	}
+}
+
+func TestNewProcessError(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "echo oops >&2; exit 3")
+	cmd.Stderr = NewStderrBuffer()
+	waitErr := cmd.Run()
+	if waitErr == nil {
+		t.Fatal("expected command to fail")
+	}
+
+	err := PrefixError("handler", NewProcessError(cmd, waitErr))
+	processErr, ok := err.(*ProcessError)
+	if !ok {
+		t.Fatalf("expected *ProcessError, got %T", err)
+	}
+
+	if processErr.Error() != "handler: exit status 3" {
+		t.Errorf("unexpected message %q", processErr.Error())
+	}
+	if processErr.ExitStatus != 3 {
+		t.Errorf("expected exit status 3, got %d", processErr.ExitStatus)
+	}
+	if processErr.Stderr != "oops\n" {
+		t.Errorf("unexpected stderr %q", processErr.Stderr)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+In this file we recognize git lfs pointer files and find their objects
+*/
+
+package lfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// Pointer files are smaller than this, according to the git lfs
+// specification
+const MaxPointerSize = 1024
+
+var pointerVersions = map[string]bool{
+	"https://git-lfs.github.com/spec/v1": true,
+	"https://hawser.github.com/spec/v1":  true, // Pre-release versions of git lfs
+}
+
+var pointerOid = regexp.MustCompile(`\Asha256:([0-9a-f]{64})\z`)
+
+var validOid = regexp.MustCompile(`\A[0-9a-f]{64}\z`)
+
+// ValidOid reports whether oid is the ID of an object, i.e. a hex SHA256
+func ValidOid(oid string) bool {
+	return validOid.MatchString(oid)
+}
+
+// Pointer is what git stores instead of the content of a git lfs object
+type Pointer struct {
+	Oid  string // Hex SHA256 of the content
+	Size int64
+}
+
+// ParsePointer returns the pointer that data holds, if it is a pointer
+// file
+func ParsePointer(data []byte) (*Pointer, bool) {
+	if len(data) >= MaxPointerSize || !bytes.HasSuffix(data, []byte("\n")) {
+		return nil, false
+	}
+
+	p := &Pointer{Size: -1}
+	for i, line := range bytes.Split(data[:len(data)-1], []byte("\n")) {
+		fields := bytes.SplitN(line, []byte(" "), 2)
+		if len(fields) != 2 {
+			return nil, false
+		}
+		key, value := string(fields[0]), string(fields[1])
+
+		switch {
+		case i == 0:
+			if key != "version" || !pointerVersions[value] {
+				return nil, false
+			}
+		case key == "oid":
+			m := pointerOid.FindStringSubmatch(value)
+			if m == nil {
+				return nil, false
+			}
+			p.Oid = m[1]
+		case key == "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, false
+			}
+			p.Size = size
+		}
+	}
+
+	if p.Oid == "" || p.Size < 0 {
+		return nil, false
+	}
+	return p, true
+}
+
+// ObjectPath returns where GitLab stores the object of p under storagePath
+func (p *Pointer) ObjectPath(storagePath string) string {
+	return filepath.Join(storagePath, p.Oid[0:2], p.Oid[2:4], p.Oid[4:])
+}
+
+// Open opens the object of p under storagePath. The object must have the
+// size that p says.
+func (p *Pointer) Open(storagePath string) (*os.File, error) {
+	file, err := os.Open(p.ObjectPath(storagePath))
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if fi.Size() != p.Size {
+		file.Close()
+		return nil, fmt.Errorf("lfs object %s: expected size %d, found %d", p.Oid, p.Size, fi.Size())
+	}
+
+	return file, nil
+}
+
+// VerifyReader returns a reader of r that fails at the end of r unless the
+// content matches the size and hash of p
+func (p *Pointer) VerifyReader(r io.Reader) io.Reader {
+	return &verifyingReader{pointer: p, r: r, hash: sha256.New()}
+}
+
+type verifyingReader struct {
+	pointer *Pointer
+	r       io.Reader
+	hash    hash.Hash
+	size    int64
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.hash.Write(b[:n])
+	v.size += int64(n)
+
+	if err == io.EOF {
+		if v.size != v.pointer.Size {
+			return n, fmt.Errorf("lfs object %s: expected size %d, read %d", v.pointer.Oid, v.pointer.Size, v.size)
+		}
+		if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != v.pointer.Oid {
+			return n, fmt.Errorf("lfs object %s: content has sha256 %s", v.pointer.Oid, sum)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package lfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testOid = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+
+func TestParsePointer(t *testing.T) {
+	p, ok := ParsePointer([]byte("version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\nsize 12345\n"))
+	if !ok {
+		t.Fatal("expected a pointer")
+	}
+	if p.Oid != testOid || p.Size != 12345 {
+		t.Fatalf("unexpected pointer %+v", p)
+	}
+
+	for _, data := range []string{
+		"",
+		"hello world\n",
+		"oid sha256:" + testOid + "\nversion https://git-lfs.github.com/spec/v1\nsize 1\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\nsize 1",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid[1:] + "\nsize 1\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\nsize -1\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\nsize 1\n" + strings.Repeat("x", MaxPointerSize),
+	} {
+		if _, ok := ParsePointer([]byte(data)); ok {
+			t.Errorf("expected %q not to be a pointer", data)
+		}
+	}
+}
+
+func TestOpenPointerObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &Pointer{Oid: testOid, Size: 5}
+	path := p.ObjectPath(dir)
+	if expected := filepath.Join(dir, "4d", "7a", testOid[4:]); path != expected {
+		t.Fatalf("expected %q, got %q", expected, path)
+	}
+
+	if _, err := p.Open(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := p.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	p.Size = 6
+	if _, err := p.Open(dir); err == nil {
+		t.Fatal("expected a size mismatch error")
+	}
+}
+
+func TestVerifyReader(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	p := &Pointer{Oid: hex.EncodeToString(sum[:]), Size: 5}
+
+	if data, err := ioutil.ReadAll(p.VerifyReader(bytes.NewReader([]byte("hello")))); err != nil || string(data) != "hello" {
+		t.Fatalf("expected %q, got %q, %v", "hello", data, err)
+	}
+	if _, err := ioutil.ReadAll(p.VerifyReader(bytes.NewReader([]byte("hellO")))); err == nil {
+		t.Fatal("expected a hash mismatch error")
+	}
+	if _, err := ioutil.ReadAll(p.VerifyReader(bytes.NewReader([]byte("hell")))); err == nil {
+		t.Fatal("expected a size mismatch error")
+	}
+}
@@ -1,7 +1,10 @@
 package queueing
 
 import (
+	"container/list"
+	"context"
 	"errors"
+	"sync"
 	"time"
 )
 
@@ -14,6 +17,11 @@ var ErrQueueingTimedout = &errQueueingTimedout{errors.New("queueing timedout")}
 type Queue struct {
 	busyCh    chan struct{}
 	waitingCh chan struct{}
+
+	// waiters holds the requests that are blocked waiting for a slot, in
+	// order of arrival
+	waitersLock sync.Mutex
+	waiters     *list.List
 }
 
 // NewQueue creates a new queue
@@ -24,6 +32,7 @@ func NewQueue(limit, queueLimit uint) *Queue {
 	return &Queue{
 		busyCh:    make(chan struct{}, limit),
 		waitingCh: make(chan struct{}, limit+queueLimit),
+		waiters:   list.New(),
 	}
 }
 
@@ -32,6 +41,19 @@ func NewQueue(limit, queueLimit uint) *Queue {
 // it allows up to (limit) of requests running at a time
 // it allows to queue up to (queue-limit) requests
 func (s *Queue) Acquire(timeout time.Duration) (err error) {
+	return s.AcquireContext(context.Background(), timeout)
+}
+
+// AcquireContext works like Acquire, but stops waiting and returns the
+// error of ctx when ctx is done.
+func (s *Queue) AcquireContext(ctx context.Context, timeout time.Duration) (err error) {
+	return s.AcquireWithProgress(ctx, timeout, 0, nil)
+}
+
+// AcquireWithProgress works like AcquireContext. If the request has to wait
+// for a slot it calls progress right away and then every interval with the
+// position of the request in the queue, starting at 1.
+func (s *Queue) AcquireWithProgress(ctx context.Context, timeout, interval time.Duration, progress func(position int)) (err error) {
 	// push item to a queue to claim your own slot (non-blocking)
 	select {
 	case s.waitingCh <- struct{}{}:
@@ -57,14 +79,57 @@ func (s *Queue) Acquire(timeout time.Duration) (err error) {
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
+	waiter := s.enqueueWaiter()
+	defer s.dequeueWaiter(waiter)
+
+	var tick <-chan time.Time
+	if progress != nil && interval > 0 {
+		progress(s.position(waiter))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
 	// push item to current processed items (blocking)
-	select {
-	case s.busyCh <- struct{}{}:
-		return nil
+	for {
+		select {
+		case s.busyCh <- struct{}{}:
+			return nil
+
+		case <-timer.C:
+			return ErrQueueingTimedout
+
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-tick:
+			progress(s.position(waiter))
+		}
+	}
+}
+
+func (s *Queue) enqueueWaiter() *list.Element {
+	s.waitersLock.Lock()
+	defer s.waitersLock.Unlock()
+	return s.waiters.PushBack(struct{}{})
+}
+
+func (s *Queue) dequeueWaiter(waiter *list.Element) {
+	s.waitersLock.Lock()
+	defer s.waitersLock.Unlock()
+	s.waiters.Remove(waiter)
+}
+
+func (s *Queue) position(waiter *list.Element) int {
+	s.waitersLock.Lock()
+	defer s.waitersLock.Unlock()
 
-	case <-timer.C:
-		return ErrQueueingTimedout
+	position := 1
+	for e := s.waiters.Front(); e != nil && e != waiter; e = e.Next() {
+		position++
 	}
+	return position
 }
 
 // Release marks the finish of processing of requests
@@ -1,6 +1,7 @@
 package queueing
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -60,3 +61,44 @@ func TestQueueProcessing(t *testing.T) {
 		t.Fatal("we should acquire slot after the previous one finished")
 	}
 }
+
+func TestQueueContextCancel(t *testing.T) {
+	q := NewQueue(1, 1)
+	if err := q.Acquire(time.Microsecond); err != nil {
+		t.Fatal("we should acquire a new slot")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.AcquireContext(ctx, time.Hour); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	q.Release()
+	if err := q.Acquire(time.Microsecond); err != nil {
+		t.Fatal("a cancelled request should not keep its place in the queue")
+	}
+}
+
+func TestQueueProgress(t *testing.T) {
+	q := NewQueue(1, 2)
+	if err := q.Acquire(time.Microsecond); err != nil {
+		t.Fatal("we should acquire a new slot")
+	}
+
+	firstQueued := make(chan struct{})
+	go q.AcquireWithProgress(context.Background(), time.Second, time.Hour, func(int) { close(firstQueued) })
+	<-firstQueued
+
+	var positions []int
+	err := q.AcquireWithProgress(context.Background(), 10*time.Millisecond, time.Millisecond, func(position int) {
+		positions = append(positions, position)
+	})
+	if err != ErrQueueingTimedout {
+		t.Fatal("we should timeout")
+	}
+
+	if len(positions) == 0 || positions[0] != 2 {
+		t.Fatalf("expected to be reported at position 2, got %v", positions)
+	}
+}
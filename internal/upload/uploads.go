@@ -34,7 +34,7 @@ func HandleFileUploads(w http.ResponseWriter, r *http.Request, h http.Handler, t
 		if err == http.ErrNotMultipart {
 			h.ServeHTTP(w, r)
 		} else {
-			helper.Fail500(w, r, fmt.Errorf("handleFileUploads: extract files from multipart: %v", err))
+			helper.Fail500(w, r, helper.PrefixError("handleFileUploads: extract files from multipart", err))
 		}
 		return
 	}
@@ -63,6 +63,10 @@ func wsRoute(regexpStr string, handler http.Handler, matchers ...matcherFunc) ro
 	}
 }
 
+func (u *Upstream) isGitDumbHTTPEnabled(*http.Request) bool {
+	return u.GitDumbHTTP
+}
+
 // Creates matcherFuncs for a particular content type.
 func isContentType(contentType string) func(*http.Request) bool {
 	return func(r *http.Request) bool {
@@ -111,6 +115,8 @@ func (u *Upstream) configureRoutes() {
 				))),
 		git.SendArchive,
 		git.SendBlob,
+		git.SendBundle,
+		git.CreateBundle,
 		git.SendDiff,
 		git.SendPatch,
 		artifacts.SendEntry,
@@ -122,8 +128,9 @@ func (u *Upstream) configureRoutes() {
 	u.Routes = []routeEntry{
 		// Git Clone
 		route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api, &u.Config)),
-		route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api)), isContentType("application/x-git-upload-pack-request")),
-		route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api)), isContentType("application/x-git-receive-pack-request")),
+		route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api, &u.Config)), isContentType("application/x-git-upload-pack-request")),
+		route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api, &u.Config)), isContentType("application/x-git-receive-pack-request")),
+		route("GET", gitProjectPattern+`(HEAD|objects/info/packs|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(pack|idx))\z`, git.DumbHTTPHandler(api), u.isGitDumbHTTPEnabled),
 		route("PUT", gitProjectPattern+`gitlab-lfs/objects/([0-9a-f]{64})/([0-9]+)\z`, lfs.PutStore(api, proxy), isContentType("application/octet-stream")),
 
 		// CI Artifacts
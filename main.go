@@ -21,10 +21,14 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
@@ -51,6 +55,34 @@ var apiQueueLimit = flag.Uint("apiQueueLimit", 0, "Number of API requests allowe
 var apiQueueTimeout = flag.Duration("apiQueueDuration", queueing.DefaultTimeout, "Maximum queueing duration of requests")
 var logFile = flag.String("logFile", "", "Log file to be used")
 var prometheusListenAddr = flag.String("prometheusListenAddr", "", "Prometheus listening address, e.g. ':9100'")
+var gitDumbHTTP = flag.Bool("gitDumbHTTP", false, "Serve read-only Git clients that use the 'dumb' HTTP protocol")
+var gitUploadPackLimit = flag.Uint("gitUploadPackLimit", 0, "Number of git upload-pack processes allowed at single time")
+var gitUploadPackQueueLimit = flag.Uint("gitUploadPackQueueLimit", 0, "Number of git upload-pack requests allowed to be queued")
+var gitUploadPackQueueTimeout = flag.Duration("gitUploadPackQueueDuration", queueing.DefaultTimeout, "Maximum queueing duration of git upload-pack requests")
+var infoRefsCacheSize = flag.Int64("infoRefsCacheSize", 0, "Maximum number of bytes of Git ref advertisements to keep in memory (0 disables the cache)")
+var pushScanHook = flag.String("pushScanHook", "", "Executable or HTTP(S) URL that scans the blobs of each git push before refs are updated")
+var pushScanTimeout = flag.Duration("pushScanTimeout", time.Minute, "Maximum duration of the content scan of a git push")
+var debugSubprocessStderr = flag.Bool("debugSubprocessStderr", false, "Copy the stderr of all subprocesses to our stderr as it comes in, not only the start of it for failed requests")
+var subprocessLimitsFile = flag.String("subprocessLimitsFile", "", "JSON file with timeouts, priorities and rlimits for each kind of subprocess")
+var archiveGzipLevel = flag.Int("archiveGzipLevel", git.DefaultArchiveCompression.Gzip, "Compression level of .tar.gz archives (1-9)")
+var archiveBzip2Level = flag.Int("archiveBzip2Level", git.DefaultArchiveCompression.Bzip2, "Compression level of .tar.bz2 archives (1-9)")
+var archiveXzLevel = flag.Int("archiveXzLevel", git.DefaultArchiveCompression.Xz, "Compression level of .tar.xz archives (0-9)")
+var archiveZstdLevel = flag.Int("archiveZstdLevel", git.DefaultArchiveCompression.Zstd, "Compression level of .tar.zst archives (1-22)")
+var archiveCacheRoot = flag.String("archiveCacheRoot", "", "Directory of the cached repository archives that gitlab-workhorse keeps within archiveCacheMaxSize and archiveCacheMaxAge")
+var archiveCacheMaxSize = flag.Int64("archiveCacheMaxSize", 0, "Maximum number of bytes of cached archives (0 means no limit)")
+var archiveCacheMaxAge = flag.Duration("archiveCacheMaxAge", 0, "Remove cached archives that have not been downloaded for this long (0 means no limit)")
+var blobDangerousContentTypes = flag.String("blobDangerousContentTypes", strings.Join(git.DefaultBlobContentTypePolicy.DangerousTypes, ","), "Comma-separated list of content types of raw blobs that browsers could run as scripts")
+var blobDangerousContent = flag.String("blobDangerousContent", git.DefaultBlobContentTypePolicy.Dangerous, "Serve raw blobs of dangerous content types as 'text' or as an 'attachment'")
+var blobContentSecurityPolicy = flag.String("blobContentSecurityPolicy", git.DefaultBlobContentTypePolicy.ContentSecurityPolicy, "Content-Security-Policy header of raw blobs (empty means none)")
+var catFileBatchMaxIdle = flag.Int("catFileBatchMaxIdle", git.DefaultCatFileBatchConfig.MaxIdle, "Maximum number of idle 'git cat-file --batch' processes kept for reading objects (0 keeps none)")
+var catFileBatchIdleTimeout = flag.Duration("catFileBatchIdleTimeout", git.DefaultCatFileBatchConfig.IdleTimeout, "Stop 'git cat-file --batch' processes that have been idle for this long (0 means no limit)")
+var catFileBatchMaxProcesses = flag.Int("catFileBatchMaxProcesses", git.DefaultCatFileBatchConfig.MaxProcesses, "Maximum number of running 'git cat-file --batch' processes; requests wait for one beyond this (0 means no limit)")
+var catFileBatchMaxPerRepository = flag.Int("catFileBatchMaxPerRepository", git.DefaultCatFileBatchConfig.MaxPerRepository, "Maximum number of running 'git cat-file --batch' processes per repository (0 means no limit)")
+var uploadPackMaxWants = flag.Int("uploadPackMaxWants", 0, "Maximum number of 'want' lines in a git fetch request (0 means no limit)")
+var uploadPackMaxDepth = flag.Int("uploadPackMaxDepth", 0, "Maximum depth of a shallow git fetch (0 means no limit)")
+var uploadPackAllowedFilters = flag.String("uploadPackAllowedFilters", "", "Comma-separated list of allowed partial clone filters, e.g. 'blob:none,blob:limit' (empty means all)")
+var uploadPackDenyDeepenSince = flag.Bool("uploadPackDenyDeepenSince", false, "Reject shallow git fetches using --shallow-since")
+var uploadPackDenyDeepenNot = flag.Bool("uploadPackDenyDeepenNot", false, "Reject shallow git fetches using --shallow-exclude")
 
 func main() {
 	flag.Usage = func() {
@@ -108,20 +140,92 @@ func main() {
 		}()
 	}
 
+	helper.SetStreamStderr(*debugSubprocessStderr)
+
+	if *subprocessLimitsFile != "" {
+		limits, err := helper.LoadProcessLimits(*subprocessLimitsFile)
+		if err != nil {
+			log.Fatalf("invalid subprocessLimitsFile: %v", err)
+		}
+		for kind, l := range limits {
+			log.Printf("Subprocess limits for %s: %v", kind, l)
+		}
+		helper.SetProcessLimits(limits)
+	}
+
+	if err := git.SetArchiveCompression(git.ArchiveCompression{
+		Gzip:  *archiveGzipLevel,
+		Bzip2: *archiveBzip2Level,
+		Xz:    *archiveXzLevel,
+		Zstd:  *archiveZstdLevel,
+	}); err != nil {
+		log.Fatalf("invalid archive compression: %v", err)
+	}
+	if *archiveCacheRoot != "" {
+		if err := git.StartArchiveCache(git.ArchiveCacheConfig{
+			Root:    *archiveCacheRoot,
+			MaxSize: *archiveCacheMaxSize,
+			MaxAge:  *archiveCacheMaxAge,
+		}); err != nil {
+			log.Fatalf("invalid archiveCacheRoot: %v", err)
+		}
+	}
+
+	if err := git.SetBlobContentTypePolicy(git.BlobContentTypePolicy{
+		DangerousTypes:        splitList(*blobDangerousContentTypes),
+		Dangerous:             *blobDangerousContent,
+		ContentSecurityPolicy: *blobContentSecurityPolicy,
+	}); err != nil {
+		log.Fatalf("invalid blob content type policy: %v", err)
+	}
+
+	if err := git.ConfigureCatFileBatch(git.CatFileBatchConfig{
+		MaxIdle:          *catFileBatchMaxIdle,
+		IdleTimeout:      *catFileBatchIdleTimeout,
+		MaxProcesses:     *catFileBatchMaxProcesses,
+		MaxPerRepository: *catFileBatchMaxPerRepository,
+	}); err != nil {
+		log.Fatalf("invalid cat-file batch configuration: %v", err)
+	}
+
 	secret.SetPath(*secretPath)
 	cfg := config.Config{
-		Backend:             backendURL,
-		Socket:              *authSocket,
-		Version:             Version,
-		DocumentRoot:        *documentRoot,
-		DevelopmentMode:     *developmentMode,
-		ProxyHeadersTimeout: *proxyHeadersTimeout,
-		APILimit:            *apiLimit,
-		APIQueueLimit:       *apiQueueLimit,
-		APIQueueTimeout:     *apiQueueTimeout,
+		Backend:                   backendURL,
+		Socket:                    *authSocket,
+		Version:                   Version,
+		DocumentRoot:              *documentRoot,
+		DevelopmentMode:           *developmentMode,
+		ProxyHeadersTimeout:       *proxyHeadersTimeout,
+		APILimit:                  *apiLimit,
+		APIQueueLimit:             *apiQueueLimit,
+		APIQueueTimeout:           *apiQueueTimeout,
+		GitDumbHTTP:               *gitDumbHTTP,
+		GitUploadPackLimit:        *gitUploadPackLimit,
+		GitUploadPackQueueLimit:   *gitUploadPackQueueLimit,
+		GitUploadPackQueueTimeout: *gitUploadPackQueueTimeout,
+		InfoRefsCacheSize:         *infoRefsCacheSize,
+		PushScanHook:              *pushScanHook,
+		PushScanTimeout:           *pushScanTimeout,
+		UploadPackPolicy: api.UploadPackPolicy{
+			MaxWants:        *uploadPackMaxWants,
+			MaxDepth:        *uploadPackMaxDepth,
+			AllowedFilters:  splitList(*uploadPackAllowedFilters),
+			DenyDeepenSince: *uploadPackDenyDeepenSince,
+			DenyDeepenNot:   *uploadPackDenyDeepenNot,
+		},
 	}
 
 	up := wrapRaven(upstream.NewUpstream(cfg))
 
 	log.Fatal(http.Serve(listener, up))
 }
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -592,6 +592,39 @@ func TestGetInfoRefsProxiedToGitalySuccessfully(t *testing.T) {
 	}
 }
 
+func TestGetInfoRefsHandledLocallyDueToHiddenRefs(t *testing.T) {
+	gitaly := startGitalyServer(nil, "Gitaly response: should never reach the client")
+	defer gitaly.Close()
+
+	apiResponse := gitOkBody(t)
+	apiResponse.GitalySocketPath = gitaly.Listener.Addr().String()
+	apiResponse.HideRefs = []string{"refs/hidden"}
+	ts := testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	resource := "/gitlab-org/gitlab-test.git/info/refs?service=git-upload-pack"
+	resp, err := http.Get(ws.URL + resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("GET %q: expected 200, got %d", resource, resp.StatusCode)
+	}
+
+	if bytes.Contains(responseBody, []byte("Gitaly response")) {
+		t.Errorf("GET %q: request should not have been proxied to Gitaly", resource)
+	}
+}
+
 func TestGetInfoRefsHandledLocallyDueToEmptyGitalySocketPath(t *testing.T) {
 	gitaly := startGitalyServer(nil, "Gitaly response: should never reach the client")
 	defer gitaly.Close()